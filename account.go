@@ -1,12 +1,28 @@
 package maillist
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 )
 
 // Account is equivalent to a user. All lists, messages, and subscribers must
-// have an associated account
+// have an associated account. Timezone is the IANA name of the timezone of
+// subscribers who don't have their own, and defaults to UTC.
+//
+// SendingWindow, if set, restricts when the account's messages are sent, e.g.
+// "mon-fri 08:00-20:00; sat 10:00-12:00" in the account's timezone. Messages
+// due outside the window are kept until it next opens.
+//
+// Warmup, if set, limits how many messages a new account sends each day while
+// its reputation is established, as a comma separated ramp of daily limits
+// counted from WarmupStart, e.g. "50,100,500,1000". Messages over the day's
+// limit are carried over to the next day. After the last day of the ramp the
+// account is unlimited. WarmupStart defaults to when the ramp was set.
+//
+// Priority weights the account's share of sending when several accounts have
+// messages waiting, e.g. an account with priority 2 sends twice as often as
+// one with priority 1. It defaults to 1.
 type Account struct {
 	ID            int64  `db:"id"`
 	ApplicationID int64  `db:"application_id" validate:"required"`
@@ -14,6 +30,11 @@ type Account struct {
 	LastName      string `db:"last_name" validate:"required"`
 	Email         string `db:"email" validate:"required"`
 	Status        string `db:"status" validate:"eq=active|eq=deleted"`
+	Timezone      string `db:"timezone"`
+	SendingWindow string `db:"sending_window"`
+	Warmup        string `db:"warmup"`
+	WarmupStart   int64  `db:"warmup_start"`
+	Priority      int    `db:"priority" validate:"min=1"`
 	CreateTime    int64  `db:"create_time" validate:"required"`
 }
 
@@ -21,15 +42,37 @@ type Account struct {
 // updated. It is an error to have duplicate email addresses for the account
 // table
 func (s *Session) InsertAccount(a *Account) error {
+	return s.InsertAccountContext(context.Background(), a)
+}
+
+// InsertAccountContext is like InsertAccount but with a context
+func (s *Session) InsertAccountContext(ctx context.Context, a *Account) error {
 	if a.Status == "" {
 		a.Status = statusActive
 	}
-	return s.insert(a)
+	if a.Priority == 0 {
+		a.Priority = 1
+	}
+	if err := checkTimezone(a.Timezone); err != nil {
+		return err
+	}
+	if err := checkSendingWindow(a.SendingWindow); err != nil {
+		return err
+	}
+	if err := checkWarmup(a); err != nil {
+		return err
+	}
+	return s.insert(ctx, a)
 }
 
 // GetAccount retrieves an account with a given ID. Returns nil,nil if that ID
 // does not exist (or has been deleted)
 func (s *Session) GetAccount(accountID int64) (*Account, error) {
+	return s.GetAccountContext(context.Background(), accountID)
+}
+
+// GetAccountContext is like GetAccount but with a context
+func (s *Session) GetAccountContext(ctx context.Context, accountID int64) (*Account, error) {
 
 	selectSQL := fmt.Sprintf(`
 SELECT %s
@@ -39,7 +82,7 @@ WHERE status!='deleted'
 		s.selectString(Account{}))
 
 	var a Account
-	if err := s.dbmap.SelectOne(&a, selectSQL, accountID); err == sql.ErrNoRows {
+	if err := s.dbmap.WithContext(ctx).SelectOne(&a, selectSQL, accountID); err == sql.ErrNoRows {
 		return nil, ErrNotFound
 
 	} else if err != nil {
@@ -52,6 +95,12 @@ WHERE status!='deleted'
 // GetAccountByApplicationID retrieves an account with a given application ID.
 // Returns nil,nil if that ID does not exist (or has been deleted)
 func (s *Session) GetAccountByApplicationID(applicationID int64) (*Account, error) {
+	return s.GetAccountByApplicationIDContext(context.Background(), applicationID)
+}
+
+// GetAccountByApplicationIDContext is like GetAccountByApplicationID but with
+// a context
+func (s *Session) GetAccountByApplicationIDContext(ctx context.Context, applicationID int64) (*Account, error) {
 
 	selectSQL := fmt.Sprintf(`
 SELECT %s
@@ -61,7 +110,7 @@ WHERE status!='deleted'
 		s.selectString(Account{}))
 
 	var a Account
-	if err := s.dbmap.SelectOne(&a, selectSQL, applicationID); err == sql.ErrNoRows {
+	if err := s.dbmap.WithContext(ctx).SelectOne(&a, selectSQL, applicationID); err == sql.ErrNoRows {
 		return nil, ErrNotFound
 
 	} else if err != nil {
@@ -73,6 +122,11 @@ WHERE status!='deleted'
 // GetAccountByEmail retrieves an account with a given email address. Returns
 // nil,nil if that email address does not exist (or has been deleted)
 func (s *Session) GetAccountByEmail(email string) (*Account, error) {
+	return s.GetAccountByEmailContext(context.Background(), email)
+}
+
+// GetAccountByEmailContext is like GetAccountByEmail but with a context
+func (s *Session) GetAccountByEmailContext(ctx context.Context, email string) (*Account, error) {
 
 	selectSQL := fmt.Sprintf(`
 SELECT %s
@@ -82,7 +136,7 @@ WHERE status!='deleted'
 		s.selectString(Account{}))
 
 	var a Account
-	if err := s.dbmap.SelectOne(&a, selectSQL, email); err == sql.ErrNoRows {
+	if err := s.dbmap.WithContext(ctx).SelectOne(&a, selectSQL, email); err == sql.ErrNoRows {
 		return nil, ErrNotFound
 
 	} else if err != nil {
@@ -93,13 +147,35 @@ WHERE status!='deleted'
 
 // UpdateAccount updates an account (identified by it's ID)
 func (s *Session) UpdateAccount(a *Account) error {
+	return s.UpdateAccountContext(context.Background(), a)
+}
+
+// UpdateAccountContext is like UpdateAccount but with a context
+func (s *Session) UpdateAccountContext(ctx context.Context, a *Account) error {
 	if a.Status == "" {
 		a.Status = statusActive
 	}
-	return s.update(a)
+	if a.Priority == 0 {
+		a.Priority = 1
+	}
+	if err := checkTimezone(a.Timezone); err != nil {
+		return err
+	}
+	if err := checkSendingWindow(a.SendingWindow); err != nil {
+		return err
+	}
+	if err := checkWarmup(a); err != nil {
+		return err
+	}
+	return s.update(ctx, a)
 }
 
 // DeleteAccount removes an account
 func (s *Session) DeleteAccount(accountID int64) error {
-	return s.delete(Account{}, accountID)
+	return s.DeleteAccountContext(context.Background(), accountID)
+}
+
+// DeleteAccountContext is like DeleteAccount but with a context
+func (s *Session) DeleteAccountContext(ctx context.Context, accountID int64) error {
+	return s.delete(ctx, Account{}, accountID)
 }
@@ -0,0 +1,124 @@
+package maillist
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+)
+
+// attributeName matches the names allowed for subscriber attributes, which
+// can be used as {{.Attr.name}} in templates
+var attributeName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]{0,63}$`)
+
+// subscriberAttribute is a single attribute of a subscriber
+type subscriberAttribute struct {
+	Name  string `db:"name"`
+	Value string `db:"value"`
+}
+
+// checkAttributes returns an error if any attribute has an invalid name
+func checkAttributes(attrs map[string]string) error {
+	for name := range attrs {
+		if !attributeName.MatchString(name) {
+			return fmt.Errorf("invalid subscriber attribute name '%s'", name)
+		}
+	}
+	return nil
+}
+
+// GetSubscriberAttributes retrieves the attributes of a subscriber. The map is
+// empty if they have none.
+func (s *Session) GetSubscriberAttributes(subscriberID int64) (map[string]string, error) {
+	return s.GetSubscriberAttributesContext(context.Background(), subscriberID)
+}
+
+// GetSubscriberAttributesContext is like GetSubscriberAttributes but with a
+// context
+func (s *Session) GetSubscriberAttributesContext(ctx context.Context, subscriberID int64) (map[string]string, error) {
+
+	selectSQL := `
+SELECT name, value
+	FROM subscriber_attribute
+
+WHERE subscriber_id=?`
+
+	var rows []subscriberAttribute
+	if _, err := s.dbmap.WithContext(ctx).Select(&rows, selectSQL, subscriberID); err != nil {
+		return nil, err
+	}
+
+	attrs := make(map[string]string)
+	for _, r := range rows {
+		attrs[r.Name] = r.Value
+	}
+	return attrs, nil
+}
+
+// SetSubscriberAttributes sets attributes of a subscriber, such as their
+// company or ticket type. Attributes not in the map are left unchanged, and
+// those set to an empty string are removed. Names must start with a letter or
+// underscore, and contain only letters, digits and underscores.
+func (s *Session) SetSubscriberAttributes(subscriberID int64, attrs map[string]string) error {
+	return s.SetSubscriberAttributesContext(context.Background(), subscriberID, attrs)
+}
+
+// SetSubscriberAttributesContext is like SetSubscriberAttributes but with a
+// context
+func (s *Session) SetSubscriberAttributesContext(ctx context.Context, subscriberID int64, attrs map[string]string) error {
+	if err := checkAttributes(attrs); err != nil {
+		return err
+	}
+
+	upsertSQL := `
+INSERT INTO subscriber_attribute
+	(subscriber_id, name, value)
+
+VALUES
+	(?, ?, ?)
+
+ON DUPLICATE KEY UPDATE
+	value=VALUES(value)`
+
+	deleteSQL := `
+DELETE FROM subscriber_attribute
+
+WHERE subscriber_id=?
+	AND name=?`
+
+	db := s.dbmap.WithContext(ctx)
+	for name, value := range attrs {
+		var err error
+		if value == "" {
+			_, err = db.Exec(deleteSQL, subscriberID, name)
+		} else {
+			_, err = db.Exec(upsertSQL, subscriberID, name, value)
+		}
+		if err != nil {
+			return fmt.Errorf("couldn't set subscriber attribute '%s': %v", name, err)
+		}
+	}
+	return nil
+}
+
+// getAttributeNames returns the names of all the attributes of a group of
+// subscribers
+func (s *Session) getAttributeNames(ctx context.Context, subscriberIDs []interface{}) ([]string, error) {
+	if len(subscriberIDs) == 0 {
+		return nil, nil
+	}
+
+	selectSQL := fmt.Sprintf(`
+SELECT DISTINCT name
+	FROM subscriber_attribute
+
+WHERE subscriber_id IN (%s)
+
+ORDER BY name`,
+		sqlPlaceholders(len(subscriberIDs)))
+
+	var names []string
+	if _, err := s.dbmap.WithContext(ctx).Select(&names, selectSQL, subscriberIDs...); err != nil {
+		return nil, err
+	}
+	return names, nil
+}
@@ -0,0 +1,164 @@
+package maillist
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// maxBatch is the largest number of recipients sent in a single batch. This
+// is the limit on personalizations in a SendGrid request.
+const maxBatch = 1000
+
+// sendBatch sends a group of pending messages belonging to the same campaign
+// in a single request. Messages whose content cannot be expressed as
+// substitutions of a common body (e.g. because the template branches on a
+// subscriber's name) are sent individually instead.
+func (s *Session) sendBatch(ctx context.Context, mailer BatchMailer, campaignID int64, ms []*Message) error {
+	campaign, err := s.GetCampaignContext(ctx, campaignID)
+	if err != nil {
+		return s.lookupFailed(ctx, fmt.Errorf("couldn't get campaign %d: %v", campaignID, err), err, ms...)
+	}
+
+	account, err := s.GetAccountContext(ctx, campaign.AccountID)
+	if err != nil {
+		return s.lookupFailed(ctx, fmt.Errorf("couldn't get account %d: %v", campaign.AccountID, err), err, ms...)
+	}
+
+	ids := make([]interface{}, len(ms))
+	for i, m := range ms {
+		ids[i] = m.SubscriberID
+	}
+	attrs, err := s.getAttributeNames(ctx, ids)
+	if err != nil {
+		return fmt.Errorf("couldn't get subscriber attributes: %v", err)
+	}
+
+	r, err := renderCampaign(s, campaign, placeholders(attrs))
+	if err != nil {
+		return s.messageFailed(ctx, &PermanentError{err}, ms...)
+	}
+
+	b := Batch{
+		From:    Address{account.FirstName + " " + account.LastName, account.Email},
+		Subject: r.subject,
+		Body:    r.text,
+		HTML:    r.html,
+	}
+	var batched []*Message
+
+	for _, m := range ms {
+		sub, err := s.GetSubscriberContext(ctx, m.SubscriberID)
+		if err != nil {
+			return fmt.Errorf("couldn't get subscriber: %v", err)
+		}
+
+		if spam, err := s.HasReportedSpamContext(ctx, sub.Email); err != nil {
+			return err
+
+		} else if spam {
+			if err = s.setMessageStatus(ctx, "cancelled", m); err != nil {
+				return err
+			}
+			continue
+		}
+
+		data, err := subscriberData(ctx, s, sub)
+		if err != nil {
+			return err
+		}
+		e, err := newEmail(s, campaign, account, sub, data)
+		if err != nil {
+			if err = s.messageFailed(ctx, err, m); err != nil {
+				return err
+			}
+			continue
+		}
+
+		// the same substitutions apply to every part, so values which
+		// would be escaped in the HTML can't be substituted
+		subs := substitutions(data, attrs)
+
+		if substitute(b.Subject, subs) != e.Subject || substitute(b.Body, subs) != e.Body ||
+			substitute(b.HTML, subs) != e.HTML {
+			if err = s.sendMessage(ctx, m); err != nil {
+				return err
+			}
+			continue
+		}
+
+		b.Recipients = append(b.Recipients, Recipient{To: e.To, Substitutions: subs})
+		batched = append(batched, m)
+	}
+
+	if len(batched) == 0 {
+		return nil
+	}
+
+	if err = mailer.SendBatch(ctx, &b); err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return s.messageFailed(ctx, err, batched...)
+	}
+
+	// as in sendMessage, record what was sent regardless of the context
+	ctx = context.Background()
+	if err = s.setMessageStatus(ctx, "sent", batched...); err != nil {
+		return err
+	}
+
+	if err = s.updateCampaignStatus(ctx, campaignID); err != nil {
+		return fmt.Errorf("couldn't update campaign status: %v", err)
+	}
+	return nil
+}
+
+// placeholders returns template data where each field, and each of the named
+// attributes, is set to its substitution key
+func placeholders(attrs []string) *templateData {
+	var d templateData
+	v := reflect.ValueOf(&d).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		if v.Field(i).Kind() == reflect.String {
+			v.Field(i).SetString(substitutionKey(v.Type().Field(i).Name))
+		}
+	}
+
+	d.Attr = make(map[string]string)
+	for _, name := range attrs {
+		d.Attr[name] = substitutionKey("Attr." + name)
+	}
+	return &d
+}
+
+// substitutions maps the substitution key of each template field, and each of
+// the named attributes, to its value
+func substitutions(d *templateData, attrs []string) map[string]string {
+	subs := make(map[string]string)
+	v := reflect.ValueOf(d).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		if v.Field(i).Kind() == reflect.String {
+			subs[substitutionKey(v.Type().Field(i).Name)] = v.Field(i).String()
+		}
+	}
+
+	for _, name := range attrs {
+		subs[substitutionKey("Attr."+name)] = d.Attr[name]
+	}
+	return subs
+}
+
+// substitute applies substitutions to a string, as the mailer would
+func substitute(s string, subs map[string]string) string {
+	var oldnew []string
+	for k, v := range subs {
+		oldnew = append(oldnew, k, v)
+	}
+	return strings.NewReplacer(oldnew...).Replace(s)
+}
+
+func substitutionKey(field string) string {
+	return "-" + field + "-"
+}
@@ -1,6 +1,7 @@
 package maillist
 
 import (
+	"context"
 	"database/sql"
 	"errors"
 	"fmt"
@@ -10,27 +11,152 @@ import (
 )
 
 // Campaign is a message template sent at a particular time to one or more
-// mailing lists
+// mailing lists.
+//
+// A campaign with a Recurrence rule is a template for recurring campaigns: at
+// each time matching the rule (see NextRecurrence) from Scheduled onwards, a
+// copy of it is scheduled with ParentID set to its ID. This continues until
+// RecurrenceEnd, if set, or until RecurrenceLimit copies have been made, after
+// which the recurring campaign is marked sent. Until then its status is
+// `recurring` and Scheduled is the time of the next occurrence.
+//
+// If LocalTime is set, the campaign is sent to each subscriber when their
+// clock shows the date and time that a UTC clock does at Scheduled, so that
+// e.g. a campaign scheduled for 9am UTC arrives at 9am in every timezone.
+//
+// Body is the plain text content of the campaign and HTMLBody the HTML
+// content, of which at least one must be set. Each e-mail is sent with both,
+// the missing one being generated from the other. Preheader is optional text
+// shown by many mail clients after the subject, which is hidden in the HTML.
+// The subject, preheader and bodies are all templates of the subscriber's
+// details, e.g. "Hi {{.FirstName}}".
 type Campaign struct {
 	ID         int64  `db:"id"`
 	AccountID  int64  `db:"account_id" validate:"required"`
 	Subject    string `db:"subject" validate:"required"`
-	Body       string `db:"body" validate:"required"`
+	Preheader  string `db:"preheader"`
+	Body       string `db:"body"`
+	HTMLBody   string `db:"html_body"`
 	Address    string `db:"address" validate:"required"`
-	Status     string `db:"status" validate:"eq=scheduled|eq=pending|eq=sent|eq=cancelled|eq=failed|eq=draft"`
+	Status     string `db:"status" validate:"eq=scheduled|eq=pending|eq=paused|eq=sent|eq=cancelled|eq=failed|eq=draft|eq=recurring|eq=transactional"`
 	ListIDs    string `db:"list_ids" validate:"-"`
 	EventIDs   string `db:"event_ids" validate:"-"`
 	Scheduled  int64  `db:"scheduled" validate:"required"`
+	LocalTime  bool   `db:"local_time"`
 	CreateTime int64  `db:"create_time" validate:"required"`
+
+	Recurrence      string `db:"recurrence"`
+	RecurrenceEnd   int64  `db:"recurrence_end"`
+	RecurrenceLimit int    `db:"recurrence_limit"`
+	Occurrences     int    `db:"occurrences"`
+	ParentID        int64  `db:"parent_id"`
 }
 
 // InsertCampaign adds the campaign to the scheduler to be sent to all its
 // subscribers
 func (s *Session) InsertCampaign(c *Campaign, listIDs []int64, eventIDs []int64) error {
+	return s.InsertCampaignContext(context.Background(), c, listIDs, eventIDs)
+}
+
+// InsertCampaignContext is like InsertCampaign but with a context
+func (s *Session) InsertCampaignContext(ctx context.Context, c *Campaign, listIDs []int64, eventIDs []int64) error {
 	if c.ListIDs != "" || c.EventIDs != "" {
 		return errors.New("Events and Mailing-lists should be passed in InsertCampaign's parameters, not as part of the structure")
 	}
 
+	if c.Status == "" {
+		c.Status = "scheduled"
+	}
+
+	if err := s.checkCampaign(ctx, c, listIDs, eventIDs); err != nil {
+		return err
+	}
+	if err := prepareRecurrence(c); err != nil {
+		return err
+	}
+
+	c.ListIDs = intsToString(listIDs)
+	c.EventIDs = intsToString(eventIDs)
+
+	err := s.insert(ctx, c)
+	if err != nil {
+		return err
+	}
+
+	s.wakeScheduler()
+	return nil
+}
+
+// UpdateCampaign changes a campaign which has not yet started sending, e.g.
+// to reschedule it. Changes to a recurring campaign apply to its future
+// occurrences. The campaign's lists and events are taken from its
+// ListIDs and EventIDs fields, as returned by GetCampaign.
+func (s *Session) UpdateCampaign(c *Campaign) error {
+	return s.UpdateCampaignContext(context.Background(), c)
+}
+
+// UpdateCampaignContext is like UpdateCampaign but with a context
+func (s *Session) UpdateCampaignContext(ctx context.Context, c *Campaign) error {
+	if err := s.checkCampaign(ctx, c, stringToInts(c.ListIDs), stringToInts(c.EventIDs)); err != nil {
+		return err
+	}
+	if err := prepareRecurrence(c); err != nil {
+		return err
+	}
+	if err := validate.Struct(c); err != nil {
+		return err
+	}
+
+	// the campaign may have started sending since it was retrieved
+	updateSQL := `
+UPDATE campaign
+	SET subject=?, preheader=?, body=?, html_body=?, address=?, status=?, list_ids=?,
+		event_ids=?, scheduled=?, local_time=?, recurrence=?, recurrence_end=?,
+		recurrence_limit=?
+
+WHERE id=?
+	AND account_id=?
+	AND status IN ('scheduled','draft','recurring')`
+
+	r, err := s.dbmap.WithContext(ctx).Exec(updateSQL, c.Subject, c.Preheader, c.Body,
+		c.HTMLBody, c.Address, c.Status, c.ListIDs, c.EventIDs, c.Scheduled, c.LocalTime, c.Recurrence, c.RecurrenceEnd,
+		c.RecurrenceLimit, c.ID, c.AccountID)
+	if err != nil {
+		return err
+	}
+
+	// MySQL doesn't count rows which were matched but left unchanged
+	if n, err := r.RowsAffected(); err != nil {
+		return err
+
+	} else if n == 0 {
+		c2, err := s.GetCampaignContext(ctx, c.ID)
+		if err != nil {
+			return err
+		}
+		if c2.AccountID != c.AccountID || (c2.Status != "scheduled" && c2.Status != "draft" && c2.Status != "recurring") {
+			return fmt.Errorf("campaign %d can no longer be changed", c.ID)
+		}
+	}
+
+	s.templatesMu.Lock()
+	delete(s.templates, c.ID)
+	s.templatesMu.Unlock()
+
+	s.wakeScheduler()
+	return nil
+}
+
+// checkCampaign checks that a campaign being inserted or updated has a valid
+// status, a body and valid templates, and is sent to lists in its own account
+func (s *Session) checkCampaign(ctx context.Context, c *Campaign, listIDs []int64, eventIDs []int64) error {
+	if err := checkBody(c); err != nil {
+		return err
+	}
+	if err := s.checkTemplates(c); err != nil {
+		return err
+	}
+
 	if len(listIDs) == 0 && len(eventIDs) == 0 {
 		return fmt.Errorf(
 			"not scheduling campaign '%s' without attached mailing lists or events",
@@ -38,7 +164,7 @@ func (s *Session) InsertCampaign(c *Campaign, listIDs []int64, eventIDs []int64)
 	}
 
 	for _, id := range listIDs {
-		list, err := s.GetList(id)
+		list, err := s.GetListContext(ctx, id)
 		if err != nil {
 			return err
 		}
@@ -52,38 +178,40 @@ func (s *Session) InsertCampaign(c *Campaign, listIDs []int64, eventIDs []int64)
 		}
 	}
 
-	c.ListIDs = intsToString(listIDs)
-	c.EventIDs = intsToString(eventIDs)
-
-	if c.Status == "" {
-		c.Status = "scheduled"
-	}
-
-	if c.Status != "scheduled" && c.Status != "draft" {
-		return fmt.Errorf("campaign status must be 'scheduled' or 'draft'")
+	if c.Status != "scheduled" && c.Status != "draft" && c.Status != "recurring" {
+		return fmt.Errorf("campaign status must be 'scheduled', 'draft' or 'recurring'")
 	}
+	return nil
+}
 
-	err := s.insert(c)
-	if err != nil {
-		return err
+// checkBody returns an error if a campaign has neither a plain text nor an
+// HTML body
+func checkBody(c *Campaign) error {
+	if strings.TrimSpace(c.Body) == "" && strings.TrimSpace(c.HTMLBody) == "" {
+		return fmt.Errorf("campaign '%s' has no body", c.Subject)
 	}
-
-	s.wake <- true
 	return nil
 }
 
-// GetCampaignsInAccount returns the campaigns for the given account
+// GetCampaignsInAccount returns the campaigns for the given account, other
+// than those created by SendTransactional
 func (s *Session) GetCampaignsInAccount(accountID int64) ([]*Campaign, error) {
+	return s.GetCampaignsInAccountContext(context.Background(), accountID)
+}
+
+// GetCampaignsInAccountContext is like GetCampaignsInAccount but with a
+// context
+func (s *Session) GetCampaignsInAccountContext(ctx context.Context, accountID int64) ([]*Campaign, error) {
 
 	selectSQL := fmt.Sprintf(`
 SELECT %s
 	FROM campaign
 
-WHERE account_id=? AND status != 'deleted'`,
+WHERE account_id=? AND status NOT IN ('deleted','transactional')`,
 		s.selectString(Campaign{}))
 
 	var cs []*Campaign
-	if _, err := s.dbmap.Select(&cs, selectSQL, accountID); err != nil {
+	if _, err := s.dbmap.WithContext(ctx).Select(&cs, selectSQL, accountID); err != nil {
 		return nil, err
 
 	} else if len(cs) == 0 {
@@ -95,13 +223,18 @@ WHERE account_id=? AND status != 'deleted'`,
 
 // CancelCampaign will cancel the given campaign from sending
 func (s *Session) CancelCampaign(campaignID int64) error {
+	return s.CancelCampaignContext(context.Background(), campaignID)
+}
+
+// CancelCampaignContext is like CancelCampaign but with a context
+func (s *Session) CancelCampaignContext(ctx context.Context, campaignID int64) error {
 	campaignSQL := `
 UPDATE campaign
 	SET status='deleted'
 
 WHERE id=?`
 
-	if _, err := s.dbmap.Exec(campaignSQL, campaignID); err != nil {
+	if _, err := s.dbmap.WithContext(ctx).Exec(campaignSQL, campaignID); err != nil {
 		return err
 	}
 
@@ -109,17 +242,85 @@ WHERE id=?`
 UPDATE message
 	SET status='cancelled'
 
-WHERE status='pending'
+WHERE status IN ('pending','sending')
 	AND campaign_id=?`
-	if _, err := s.dbmap.Exec(messageSQL, campaignID); err != nil {
+	if _, err := s.dbmap.WithContext(ctx).Exec(messageSQL, campaignID); err != nil {
 		return err
 	}
 
+	s.wakeScheduler()
+	return nil
+}
+
+// PauseCampaign stops a campaign which is being sent. Its unsent messages are
+// kept until the campaign is resumed, though messages already being sent may
+// still go out.
+func (s *Session) PauseCampaign(campaignID int64) error {
+	return s.PauseCampaignContext(context.Background(), campaignID)
+}
+
+// PauseCampaignContext is like PauseCampaign but with a context
+func (s *Session) PauseCampaignContext(ctx context.Context, campaignID int64) error {
+	updateSQL := `
+UPDATE campaign
+	SET status='paused'
+
+WHERE status='pending'
+	AND id=?`
+
+	if r, err := s.dbmap.WithContext(ctx).Exec(updateSQL, campaignID); err != nil {
+		return err
+
+	} else if n, err := r.RowsAffected(); err != nil {
+		return err
+
+	} else if n == 0 {
+		return fmt.Errorf("campaign %d is not being sent", campaignID)
+	}
+	return nil
+}
+
+// ResumeCampaign continues sending a paused campaign
+func (s *Session) ResumeCampaign(campaignID int64) error {
+	return s.ResumeCampaignContext(context.Background(), campaignID)
+}
+
+// ResumeCampaignContext is like ResumeCampaign but with a context
+func (s *Session) ResumeCampaignContext(ctx context.Context, campaignID int64) error {
+	updateSQL := `
+UPDATE campaign
+	SET status='pending'
+
+WHERE status='paused'
+	AND id=?`
+
+	if r, err := s.dbmap.WithContext(ctx).Exec(updateSQL, campaignID); err != nil {
+		return err
+
+	} else if n, err := r.RowsAffected(); err != nil {
+		return err
+
+	} else if n == 0 {
+		return fmt.Errorf("campaign %d is not paused", campaignID)
+	}
+
+	// messages being sent when the campaign was paused may have been the
+	// last, in which case it is already complete
+	if err := s.updateCampaignStatus(ctx, campaignID); err != nil {
+		return err
+	}
+
+	s.wakeSender()
 	return nil
 }
 
 // GetCampaign retrieves a campaign with a given ID
 func (s *Session) GetCampaign(campaignID int64) (*Campaign, error) {
+	return s.GetCampaignContext(context.Background(), campaignID)
+}
+
+// GetCampaignContext is like GetCampaign but with a context
+func (s *Session) GetCampaignContext(ctx context.Context, campaignID int64) (*Campaign, error) {
 
 	selectSQL := fmt.Sprintf(`
 SELECT %s
@@ -130,7 +331,7 @@ WHERE id=?
 		s.selectString(Campaign{}))
 
 	var c Campaign
-	if err := s.dbmap.SelectOne(&c, selectSQL, campaignID); err == sql.ErrNoRows {
+	if err := s.dbmap.WithContext(ctx).SelectOne(&c, selectSQL, campaignID); err == sql.ErrNoRows {
 		return nil, ErrNotFound
 
 	} else if err != nil {
@@ -140,26 +341,24 @@ WHERE id=?
 }
 
 // sendCampaign takes a scheduled campaign and adds it's messages to the queue
-// of pending messages
-func (s *Session) sendCampaign(campaignID int64) error {
-
-	updateSQL := `
-UPDATE campaign
-	SET status='pending'
-
-WHERE status='scheduled'
-	AND id=?`
-
-	if r, err := s.dbmap.Exec(updateSQL, campaignID); err != nil {
-		return err
-
-	} else if r2, err := r.RowsAffected(); r2 != 1 {
+// of pending messages. Messages of a campaign sent at local time are not sent
+// before the scheduled time in the subscriber's timezone. The campaign is
+// expanded in a single transaction, so that if it fails part way through it
+// is left scheduled to be expanded again, rather than partially sent.
+func (s *Session) sendCampaign(ctx context.Context, campaignID int64) error {
+	c, err := s.GetCampaignContext(ctx, campaignID)
+	if err != nil {
 		return err
 	}
+	if c.Status != "scheduled" {
+		return nil
+	}
 
-	c, err := s.GetCampaign(campaignID)
-	if err != nil {
-		return err
+	var account *Account
+	if c.LocalTime {
+		if account, err = s.GetAccountContext(ctx, c.AccountID); err != nil {
+			return err
+		}
 	}
 
 	listIDs := stringToInts(c.ListIDs)
@@ -176,10 +375,10 @@ WHERE status='scheduled'
 				continue
 			}
 
-			sub2, err = s.GetSubscriberByEmail(sub.Email, c.AccountID)
+			sub2, err = s.GetSubscriberByEmailContext(ctx, sub.Email, c.AccountID)
 			if err == ErrNotFound {
 				sub.AccountID = c.AccountID
-				if err = s.InsertSubscriber(sub); err != nil {
+				if err = s.InsertSubscriberContext(ctx, sub); err != nil {
 					return err
 				}
 				subsToSend[sub.Email] = sub
@@ -196,7 +395,7 @@ WHERE status='scheduled'
 	// Add all the subscribers in the campaign lists to subsToSend
 	for _, listID := range listIDs {
 		var subs []*Subscriber
-		subs, err = s.GetSubscribers(listID)
+		subs, err = s.GetSubscribersContext(ctx, listID)
 		if err != nil && err != ErrNotFound {
 			return err
 		}
@@ -207,6 +406,28 @@ WHERE status='scheduled'
 		}
 	}
 
+	updateSQL := `
+UPDATE campaign
+	SET status='pending'
+
+WHERE status='scheduled'
+	AND id=?`
+
+	tx, err := s.dbmap.Begin()
+	if err != nil {
+		return err
+	}
+
+	// another session may have expanded the campaign first
+	if r, err := tx.WithContext(ctx).Exec(updateSQL, campaignID); err != nil {
+		tx.Rollback()
+		return err
+
+	} else if r2, err := r.RowsAffected(); r2 != 1 {
+		tx.Rollback()
+		return err
+	}
+
 	for _, sub := range subsToSend {
 		if sub.Status != statusActive {
 			continue
@@ -216,31 +437,51 @@ WHERE status='scheduled'
 			SubscriberID: sub.ID,
 			CampaignID:   campaignID,
 			Status:       "pending",
+			Domain:       emailDomain(sub.Email),
+			CreateTime:   time.Now().Unix(),
+		}
+		if c.LocalTime {
+			m.NextAttempt = wallClock(c.Scheduled, location(sub.Timezone, account.Timezone))
 		}
 
-		if err = s.InsertMessage(&m); err != nil {
-			break
+		if err = tx.WithContext(ctx).Insert(&m); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("couldn't queue message to subscriber %d: %v", sub.ID, err)
 		}
 	}
 
-	return err
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("couldn't commit campaign messages: %v", err)
+	}
+	return nil
 }
 
-// getDueCampaign retrieves a campaign that is due to be sent. It returns
-// nil,nil if none are due
-func getDueCampaign(s *Session) (*Campaign, error) {
+// getDueCampaign retrieves a campaign that is due to be sent, other than those
+// given, earliest first. It returns nil,ErrNotFound if none are due. Campaigns
+// sent at local time are due as soon as their time is reached in any
+// timezone.
+func getDueCampaign(ctx context.Context, s *Session, skip []interface{}) (*Campaign, error) {
+	var exclude string
+	if len(skip) > 0 {
+		exclude = fmt.Sprintf("AND id NOT IN (%s)", sqlPlaceholders(len(skip)))
+	}
+
 	var c Campaign
 	selectSQL := fmt.Sprintf(`
 SELECT %s
 	FROM campaign
 
 WHERE status='scheduled'
-	AND scheduled<=?
+	AND scheduled<=IF(local_time, ?, ?)
+	%s
 
+ORDER BY scheduled, id
 LIMIT 1`,
-		s.selectString(&c))
+		s.selectString(&c), exclude)
 
-	err := s.dbmap.SelectOne(&c, selectSQL, time.Now().Unix())
+	now := time.Now()
+	args := append([]interface{}{now.Add(maxUTCOffset).Unix(), now.Unix()}, skip...)
+	err := s.dbmap.WithContext(ctx).SelectOne(&c, selectSQL, args...)
 	if err == sql.ErrNoRows {
 		return nil, ErrNotFound
 
@@ -252,30 +493,51 @@ LIMIT 1`,
 }
 
 // UpdateCampaignStatus checks if all a campaigns messages have been sent, and
-// updates status from `pending` to `sent`.
-func (s *Session) updateCampaignStatus(campaignID int64) error {
+// updates status from `pending` to `sent`. If every message failed, the
+// campaign is marked `failed` instead.
+func (s *Session) updateCampaignStatus(ctx context.Context, campaignID int64) error {
 
-	selectSQL := `
+	unsentSQL := `
 SELECT count(*)
 	FROM message
 
-WHERE status='pending'
+WHERE status IN ('pending','sending')
 	AND campaign_id=?`
 
-	if count, err := s.dbmap.SelectInt(selectSQL, campaignID); err != nil {
+	db := s.dbmap.WithContext(ctx)
+	if count, err := db.SelectInt(unsentSQL, campaignID); err != nil {
 		return err
 
 	} else if count > 0 {
 		return nil
 	}
 
+	selectSQL := `
+SELECT count(*)
+	FROM message
+
+WHERE status=?
+	AND campaign_id=?`
+
+	status := "sent"
+	if sent, err := db.SelectInt(selectSQL, "sent", campaignID); err != nil {
+		return err
+
+	} else if failed, err := db.SelectInt(selectSQL, "failed", campaignID); err != nil {
+		return err
+
+	} else if sent == 0 && failed > 0 {
+		status = "failed"
+	}
+
 	updateSQL := `
 UPDATE campaign
-	SET status='sent'
+	SET status=?
 
-WHERE id=?`
+WHERE id=?
+	AND status='pending'`
 
-	_, err := s.dbmap.Exec(updateSQL, campaignID)
+	_, err := db.Exec(updateSQL, status, campaignID)
 	return err
 }
 
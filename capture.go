@@ -0,0 +1,54 @@
+package maillist
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+)
+
+var captureCount int64
+
+// FileMailer writes each e-mail as a complete RFC 5322 message to disk
+// instead of sending it. If Maildir is set, messages are delivered to the
+// Maildir at Dir; otherwise they are written to Dir as .eml files.
+type FileMailer struct {
+	Dir     string
+	Maildir bool
+}
+
+// Send writes a single e-mail to disk
+func (m *FileMailer) Send(ctx context.Context, e *Email) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	now := time.Now()
+	host, _ := os.Hostname()
+	name := fmt.Sprintf("%d.M%dP%dQ%d.%s", now.Unix(), now.Nanosecond()/1000,
+		os.Getpid(), atomic.AddInt64(&captureCount, 1), host)
+	buf := formatEmail(e, now)
+
+	if !m.Maildir {
+		if err := os.MkdirAll(m.Dir, 0755); err != nil {
+			return err
+		}
+		return ioutil.WriteFile(filepath.Join(m.Dir, name+".eml"), buf, 0644)
+	}
+
+	for _, dir := range []string{"tmp", "new", "cur"} {
+		if err := os.MkdirAll(filepath.Join(m.Dir, dir), 0755); err != nil {
+			return err
+		}
+	}
+
+	// messages are written to tmp and moved to new once complete, so that
+	// readers never see a partial message
+	tmp := filepath.Join(m.Dir, "tmp", name)
+	if err := ioutil.WriteFile(tmp, buf, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(m.Dir, "new", name))
+}
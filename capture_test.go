@@ -0,0 +1,129 @@
+package maillist_test
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/Attendly/maillist"
+)
+
+func TestFileMailer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "maillist")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	e := maillist.Email{
+		From:    maillist.Address{Name: "Joe Bloggs", Address: "joe@example.com"},
+		To:      maillist.Address{Name: "Tommy Barker", Address: "tom@example.com"},
+		Subject: "Awesome Event 2016",
+		Body:    "Hi Tommy Barker,\nThis is a test of attendly email list service",
+	}
+
+	for _, maildir := range []bool{false, true} {
+		m := maillist.FileMailer{Dir: filepath.Join(dir, "out"), Maildir: maildir}
+		if maildir {
+			m.Dir = filepath.Join(dir, "Maildir")
+		}
+		if err := m.Send(context.Background(), &e); err != nil {
+			t.Fatalf("could not write email: %v", err)
+		}
+
+		pattern := filepath.Join(m.Dir, "*.eml")
+		if maildir {
+			pattern = filepath.Join(m.Dir, "new", "*")
+		}
+		files, _ := filepath.Glob(pattern)
+		if len(files) != 1 {
+			t.Fatalf("got %d files matching %s, want 1", len(files), pattern)
+		}
+
+		f, err := os.Open(files[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg, err := mail.ReadMessage(f)
+		f.Close()
+		if err != nil {
+			t.Fatalf("could not parse email: %v", err)
+		}
+
+		if got := msg.Header.Get("Subject"); got != e.Subject {
+			t.Errorf("got subject '%s', want '%s'", got, e.Subject)
+		}
+		if got := msg.Header.Get("To"); got != `"Tommy Barker" <tom@example.com>` {
+			t.Errorf("got recipient '%s'", got)
+		}
+		body, _ := ioutil.ReadAll(msg.Body)
+		if !strings.Contains(string(body), "This is a test of attendly email list service") {
+			t.Errorf("body missing from email:\n%s", body)
+		}
+	}
+}
+
+func TestFileMailerMultipart(t *testing.T) {
+	dir, err := ioutil.TempDir("", "maillist")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	e := maillist.Email{
+		From:    maillist.Address{Name: "Joe Bloggs", Address: "joe@example.com"},
+		To:      maillist.Address{Name: "Tommy Barker", Address: "tom@example.com"},
+		Subject: "Awesome Event 2016",
+		Body:    "Hi Tommy Barker",
+		HTML:    "<p>Hi <b>Tommy Barker</b></p>",
+	}
+
+	m := maillist.FileMailer{Dir: dir}
+	if err := m.Send(context.Background(), &e); err != nil {
+		t.Fatalf("could not write email: %v", err)
+	}
+
+	files, _ := filepath.Glob(filepath.Join(dir, "*.eml"))
+	if len(files) != 1 {
+		t.Fatalf("got %d files, want 1", len(files))
+	}
+	f, err := os.Open(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	msg, err := mail.ReadMessage(f)
+	if err != nil {
+		t.Fatalf("could not parse email: %v", err)
+	}
+
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/alternative" {
+		t.Fatalf("got content type '%s', want multipart/alternative", msg.Header.Get("Content-Type"))
+	}
+
+	r := multipart.NewReader(msg.Body, params["boundary"])
+	for _, want := range []struct{ contentType, body string }{
+		{"text/plain; charset=utf-8", e.Body},
+		{"text/html; charset=utf-8", e.HTML},
+	} {
+		p, err := r.NextPart()
+		if err != nil {
+			t.Fatalf("could not read %s part: %v", want.contentType, err)
+		}
+		body, _ := ioutil.ReadAll(p)
+		if got := p.Header.Get("Content-Type"); got != want.contentType || string(body) != want.body {
+			t.Errorf("got %s part %q, want %s part %q", got, body, want.contentType, want.body)
+		}
+	}
+	if _, err := r.NextPart(); err != io.EOF {
+		t.Errorf("got more than two parts")
+	}
+}
@@ -0,0 +1,281 @@
+package maillist
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var claimCount int64
+
+// newInstanceID generates an identifier for a session which is unique across
+// processes and hosts
+func newInstanceID() string {
+	host, _ := os.Hostname()
+	var buf [4]byte
+	rand.Read(buf[:])
+	return fmt.Sprintf("%s-%d-%s", host, os.Getpid(), hex.EncodeToString(buf[:]))
+}
+
+// claim atomically takes ownership of up to limit messages from a single
+// campaign, by moving them from `pending` to `sending` under a lease. Messages
+// whose lease has expired (e.g. because their session crashed) are claimed as
+// if they were pending. Messages of paused campaigns are not claimed, and no
+// more messages are claimed to each domain than this session's throttle
+// allows. Campaigns are chosen fairly between accounts (see fairQueue), so
+// that a large campaign doesn't hold up the others, and transactional e-mails
+// go first. The campaigns to choose from are cached for up to candidateTTL.
+// Any number of sessions may claim from the same queue without a message
+// being sent twice.
+func (s *Session) claim(ctx context.Context, limit int) (*job, error) {
+	db := s.dbmap.WithContext(ctx)
+	for {
+		now := time.Now().Unix()
+
+		// domains with a quota are claimed from separately, up to the quota
+		quotas := s.domains.quotas(limit)
+		var exclude, throttled string
+		var limited, empty []interface{}
+		for domain, n := range quotas {
+			limited = append(limited, domain)
+			if n == 0 {
+				empty = append(empty, domain)
+			}
+		}
+		if len(limited) > 0 {
+			exclude = fmt.Sprintf("AND message.domain NOT IN (%s)", sqlPlaceholders(len(limited)))
+		}
+		if len(empty) > 0 {
+			throttled = fmt.Sprintf("AND message.domain NOT IN (%s)", sqlPlaceholders(len(empty)))
+		}
+
+		candidateSQL := fmt.Sprintf(`
+SELECT DISTINCT campaign.account_id, message.campaign_id, account.priority,
+		campaign.status='transactional' AS transactional
+	FROM message
+
+INNER JOIN campaign
+	ON campaign.id=message.campaign_id
+
+INNER JOIN account
+	ON account.id=campaign.account_id
+
+WHERE ((message.status='pending' AND next_attempt<=?)
+		OR (message.status='sending' AND lease_expires<?))
+	AND campaign.status!='paused'
+	%s`,
+			throttled)
+
+		candidates := s.candidates.get()
+		if candidates == nil {
+			if _, err := db.Select(&candidates, candidateSQL, append([]interface{}{now, now}, empty...)...); err != nil {
+				return nil, err
+			}
+			s.candidates.set(candidates)
+		}
+
+		next := s.queue.next(candidates)
+		if next == nil {
+			return nil, ErrNotFound
+		}
+		campaignID := next.CampaignID
+
+		j := job{
+			campaignID: campaignID,
+			owner:      s.id + "/" + strconv.FormatInt(atomic.AddInt64(&claimCount, 1), 10),
+		}
+		lease := time.Now().Add(s.config.ClaimLease).Unix()
+
+		// claimDomains claims up to n messages to the domains matched by a
+		// condition, and returns how many were claimed
+		claimDomains := func(condition string, n int, domains ...interface{}) (int, error) {
+			updateSQL := fmt.Sprintf(`
+UPDATE message
+	SET status='sending', owner=?, lease_expires=?
+
+WHERE campaign_id=?
+	AND ((status='pending' AND next_attempt<=?)
+		OR (status='sending' AND lease_expires<?))
+	AND NOT EXISTS (SELECT 1 FROM campaign WHERE id=? AND status='paused')
+	%s
+
+ORDER BY subscriber_id
+LIMIT ?`,
+				condition)
+
+			args := append([]interface{}{j.owner, lease, campaignID, now, now, campaignID}, domains...)
+			r, err := db.Exec(updateSQL, append(args, n)...)
+			if err != nil {
+				return 0, err
+			}
+			claimed, err := r.RowsAffected()
+			return int(claimed), err
+		}
+
+		remaining := limit
+		claimed, err := claimDomains(exclude, remaining, limited...)
+		if err != nil {
+			return nil, err
+		}
+		remaining -= claimed
+
+		if remaining > 0 && len(limited) > len(empty) {
+			domainSQL := fmt.Sprintf(`
+SELECT DISTINCT domain
+	FROM message
+
+WHERE campaign_id=?
+	AND ((status='pending' AND next_attempt<=?)
+		OR (status='sending' AND lease_expires<?))
+	AND domain IN (%s)`,
+				sqlPlaceholders(len(limited)))
+
+			var domains []string
+			if _, err = db.Select(&domains, domainSQL, append([]interface{}{campaignID, now, now}, limited...)...); err != nil {
+				return nil, err
+			}
+
+			for _, domain := range domains {
+				n := quotas[domain]
+				if n > remaining {
+					n = remaining
+				}
+				if n == 0 {
+					continue
+				}
+				if claimed, err = claimDomains("AND domain=?", n, domain); err != nil {
+					return nil, err
+				}
+				if remaining -= claimed; remaining == 0 {
+					break
+				}
+			}
+		}
+
+		selectSQL := fmt.Sprintf(`
+SELECT %s
+	FROM message
+
+WHERE owner=?
+	AND status='sending'`,
+			s.selectString(Message{}))
+
+		if _, err := db.Select(&j.messages, selectSQL, j.owner); err != nil {
+			return nil, err
+		}
+
+		// another session may have claimed the same messages first, or the
+		// cached campaign may have none left
+		if len(j.messages) > 0 {
+			return &j, nil
+		}
+		s.candidates.remove(campaignID)
+	}
+}
+
+// candidateTTL is how long the campaigns with messages to claim are cached,
+// unless this session queues new messages first
+const candidateTTL = time.Second
+
+// candidateCache holds the campaigns found to have messages to claim, so that
+// the message table needn't be searched for every claim. Campaigns are removed
+// once a claim from them finds nothing.
+type candidateCache struct {
+	mu         sync.Mutex
+	candidates []*claimCandidate
+	expires    time.Time
+}
+
+// get returns a copy of the cached candidates, or nil if they must be looked
+// up again
+func (c *candidateCache) get() []*claimCandidate {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.candidates) == 0 || time.Now().After(c.expires) {
+		return nil
+	}
+	return append([]*claimCandidate(nil), c.candidates...)
+}
+
+func (c *candidateCache) set(candidates []*claimCandidate) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.candidates = append([]*claimCandidate(nil), candidates...)
+	c.expires = time.Now().Add(candidateTTL)
+}
+
+func (c *candidateCache) remove(campaignID int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i, candidate := range c.candidates {
+		if candidate.CampaignID == campaignID {
+			c.candidates = append(c.candidates[:i:i], c.candidates[i+1:]...)
+			return
+		}
+	}
+}
+
+// invalidate causes the candidates to be looked up again by the next claim
+func (c *candidateCache) invalidate() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.candidates = nil
+}
+
+// release returns any messages of a job which were not sent or failed to the
+// queue, so that they can be claimed again without waiting for the lease to
+// expire
+func (s *Session) release(ctx context.Context, j *job) error {
+	updateSQL := `
+UPDATE message
+	SET status='pending', owner=''
+
+WHERE owner=?
+	AND status='sending'`
+
+	_, err := s.dbmap.WithContext(ctx).Exec(updateSQL, j.owner)
+	return err
+}
+
+// renewClaim extends the lease on a job's messages every third of
+// Config.ClaimLease until the returned function is called, so that other
+// sessions don't claim them however long they take to send
+func (s *Session) renewClaim(ctx context.Context, j *job) (stop func()) {
+	updateSQL := `
+UPDATE message
+	SET lease_expires=?
+
+WHERE owner=?
+	AND status='sending'`
+
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(s.config.ClaimLease / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+			case <-done:
+				return
+			}
+
+			lease := time.Now().Add(s.config.ClaimLease).Unix()
+			if _, err := s.dbmap.WithContext(ctx).Exec(updateSQL, lease, j.owner); err != nil && ctx.Err() == nil {
+				s.error("couldn't renew claim on messages:", err)
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
@@ -0,0 +1,214 @@
+package maillist
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cronSchedule is a parsed cron expression. Each field is a bit set of the
+// values it matches.
+type cronSchedule struct {
+	minute, hour, dom, month, dow uint64
+
+	// if either day field is unrestricted, only the other is checked;
+	// otherwise a day matching either is accepted, as in cron
+	domStar, dowStar bool
+
+	loc *time.Location
+}
+
+// cronMacros are the shorthand schedules understood by parseCron
+var cronMacros = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+var (
+	monthNames = []string{"jan", "feb", "mar", "apr", "may", "jun", "jul", "aug", "sep", "oct", "nov", "dec"}
+	dayNames   = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+)
+
+// parseCron parses a standard five field cron expression (minute, hour, day
+// of month, month and day of week), or one of the macros such as @weekly.
+// Fields may be lists of values, ranges and steps, and months and days of the
+// week may be given by their three letter names. Times are in UTC unless the
+// expression is prefixed by CRON_TZ= and a location, e.g.
+// "CRON_TZ=Australia/Melbourne 0 9 * * mon".
+func parseCron(spec string) (*cronSchedule, error) {
+	c := cronSchedule{loc: time.UTC}
+
+	spec = strings.TrimSpace(spec)
+	if strings.HasPrefix(spec, "CRON_TZ=") || strings.HasPrefix(spec, "TZ=") {
+		i := strings.IndexAny(spec, " \t")
+		if i < 0 {
+			return nil, fmt.Errorf("cron expression '%s' has no schedule", spec)
+		}
+		loc, err := time.LoadLocation(spec[strings.Index(spec, "=")+1 : i])
+		if err != nil {
+			return nil, fmt.Errorf("cron expression '%s': %v", spec, err)
+		}
+		c.loc = loc
+		spec = strings.TrimSpace(spec[i:])
+	}
+
+	if macro, ok := cronMacros[spec]; ok {
+		spec = macro
+	}
+
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("cron expression '%s' must have 5 fields", spec)
+	}
+
+	var err error
+	if c.minute, err = parseCronField(fields[0], 0, 59, nil); err != nil {
+		return nil, err
+	}
+	if c.hour, err = parseCronField(fields[1], 0, 23, nil); err != nil {
+		return nil, err
+	}
+	if c.dom, err = parseCronField(fields[2], 1, 31, nil); err != nil {
+		return nil, err
+	}
+	if c.month, err = parseCronField(fields[3], 1, 12, monthNames); err != nil {
+		return nil, err
+	}
+	if c.dow, err = parseCronField(fields[4], 0, 7, dayNames); err != nil {
+		return nil, err
+	}
+
+	// both 0 and 7 are Sunday
+	if c.dow&(1<<7) != 0 {
+		c.dow |= 1
+	}
+	c.domStar = fields[2] == "*" || fields[2] == "?"
+	c.dowStar = fields[4] == "*" || fields[4] == "?"
+	return &c, nil
+}
+
+// parseCronField parses a comma separated list of values, ranges (a-b) and
+// steps (*/n or a-b/n) into a bit set. Names, if given, stand for values
+// starting at min.
+func parseCronField(field string, min, max int, names []string) (uint64, error) {
+	var bits uint64
+
+	value := func(s string) (int, error) {
+		for i, name := range names {
+			if strings.EqualFold(s, name) {
+				return min + i, nil
+			}
+		}
+		n, err := strconv.Atoi(s)
+		if err != nil || n < min || n > max {
+			return 0, fmt.Errorf("cron field '%s': '%s' is not between %d and %d", field, s, min, max)
+		}
+		return n, nil
+	}
+
+	for _, part := range strings.Split(field, ",") {
+		rng, step := part, 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			var err error
+			if step, err = strconv.Atoi(part[i+1:]); err != nil || step < 1 {
+				return 0, fmt.Errorf("cron field '%s': invalid step '%s'", field, part[i+1:])
+			}
+			rng = part[:i]
+		}
+
+		lo, hi := min, max
+		switch {
+		case rng == "*" || rng == "?":
+
+		case strings.Contains(rng, "-"):
+			i := strings.Index(rng, "-")
+			var err error
+			if lo, err = value(rng[:i]); err != nil {
+				return 0, err
+			}
+			if hi, err = value(rng[i+1:]); err != nil {
+				return 0, err
+			}
+			if hi < lo {
+				return 0, fmt.Errorf("cron field '%s': range '%s' is backwards", field, rng)
+			}
+
+		default:
+			var err error
+			if lo, err = value(rng); err != nil {
+				return 0, err
+			}
+			// a single value with a step runs to the end of the range
+			if step == 1 {
+				hi = lo
+			}
+		}
+
+		for i := lo; i <= hi; i += step {
+			bits |= 1 << uint(i)
+		}
+	}
+	return bits, nil
+}
+
+// next returns the first time matching the schedule strictly after t, or the
+// zero time if there is none within five years (e.g. for "0 0 30 2 *").
+func (c *cronSchedule) next(t time.Time) time.Time {
+	t = t.In(c.loc)
+	t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), 0, 0, c.loc).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+
+	for t.Before(limit) {
+		switch {
+		case c.month&(1<<uint(t.Month())) == 0:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, c.loc)
+
+		case !c.dayMatches(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, c.loc)
+
+		case c.hour&(1<<uint(t.Hour())) == 0:
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, c.loc)
+
+		case c.minute&(1<<uint(t.Minute())) == 0:
+			t = t.Add(time.Minute)
+
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+func (c *cronSchedule) dayMatches(t time.Time) bool {
+	dom := c.dom&(1<<uint(t.Day())) != 0
+	dow := c.dow&(1<<uint(t.Weekday())) != 0
+
+	switch {
+	case c.domStar:
+		return dow
+	case c.dowStar:
+		return dom
+	}
+	return dom || dow
+}
+
+// NextRecurrence returns the first time after t at which a campaign with the
+// given recurrence rule (see Campaign.Recurrence) is sent, or an error if the
+// rule is invalid or never recurs.
+func NextRecurrence(rule string, t time.Time) (time.Time, error) {
+	c, err := parseCron(rule)
+	if err != nil {
+		return time.Time{}, err
+	}
+	next := c.next(t)
+	if next.IsZero() {
+		return next, fmt.Errorf("cron expression '%s' never recurs", rule)
+	}
+	return next, nil
+}
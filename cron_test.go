@@ -0,0 +1,62 @@
+package maillist_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Attendly/maillist"
+)
+
+func TestNextRecurrence(t *testing.T) {
+	melbourne, err := time.LoadLocation("Australia/Melbourne")
+	if err != nil {
+		t.Skip("no timezone database:", err)
+	}
+
+	// a Wednesday
+	start := time.Date(2016, 6, 15, 10, 30, 0, 0, time.UTC)
+
+	for _, test := range []struct {
+		rule string
+		want time.Time
+	}{
+		{"*/15 * * * *", time.Date(2016, 6, 15, 10, 45, 0, 0, time.UTC)},
+		{"0 9 * * *", time.Date(2016, 6, 16, 9, 0, 0, 0, time.UTC)},
+		{"@daily", time.Date(2016, 6, 16, 0, 0, 0, 0, time.UTC)},
+		{"0 9 * * mon-fri", time.Date(2016, 6, 16, 9, 0, 0, 0, time.UTC)},
+		{"0 9 * * 1", time.Date(2016, 6, 20, 9, 0, 0, 0, time.UTC)},
+		{"0 9 * * 7", time.Date(2016, 6, 19, 9, 0, 0, 0, time.UTC)},
+		{"30 10 15 6 *", time.Date(2017, 6, 15, 10, 30, 0, 0, time.UTC)},
+		{"0 0 1 * *", time.Date(2016, 7, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 12 1,20 jan,jun *", time.Date(2016, 6, 20, 12, 0, 0, 0, time.UTC)},
+		{"0 0 29 2 *", time.Date(2020, 2, 29, 0, 0, 0, 0, time.UTC)},
+
+		// day of month or day of week when both are restricted
+		{"0 0 1 * fri", time.Date(2016, 6, 17, 0, 0, 0, 0, time.UTC)},
+
+		{"CRON_TZ=Australia/Melbourne 0 9 * * *", time.Date(2016, 6, 16, 9, 0, 0, 0, melbourne)},
+	} {
+		got, err := maillist.NextRecurrence(test.rule, start)
+		if err != nil {
+			t.Errorf("%s: %v", test.rule, err)
+		} else if !got.Equal(test.want) {
+			t.Errorf("%s: got %v, want %v", test.rule, got, test.want)
+		}
+	}
+
+	for _, rule := range []string{
+		"",
+		"* * * *",
+		"60 * * * *",
+		"* * 0 * *",
+		"5-1 * * * *",
+		"*/0 * * * *",
+		"* * * foo *",
+		"CRON_TZ=Nowhere/Special * * * * *",
+		"0 0 30 2 *",
+	} {
+		if _, err := maillist.NextRecurrence(rule, start); err == nil {
+			t.Errorf("%s: expected an error", rule)
+		}
+	}
+}
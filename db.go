@@ -1,6 +1,7 @@
 package maillist
 
 import (
+	"context"
 	"database/sql"
 	"errors"
 	"fmt"
@@ -59,18 +60,18 @@ func openDatabase(address string) (d database, err error) {
 	return
 }
 
-func (d *database) insert(i interface{}) error {
+func (d *database) insert(ctx context.Context, i interface{}) error {
 
 	reflect.Indirect(reflect.ValueOf(i)).FieldByName("CreateTime").SetInt(time.Now().Unix())
 
 	if err := validate.Struct(i); err != nil {
 		return err
 	}
-	err := d.dbmap.Insert(i)
+	err := d.dbmap.WithContext(ctx).Insert(i)
 	return err
 }
 
-func (d *database) delete(i interface{}, id int64) error {
+func (d *database) delete(ctx context.Context, i interface{}, id int64) error {
 	t := reflect.TypeOf(i)
 	tab, ok := d.tables[t]
 	if !ok {
@@ -78,15 +79,15 @@ func (d *database) delete(i interface{}, id int64) error {
 	}
 
 	sql := fmt.Sprintf("update %s set status='deleted' where id=?", tab.name)
-	_, err := d.dbmap.Exec(sql, id)
+	_, err := d.dbmap.WithContext(ctx).Exec(sql, id)
 	return err
 }
 
-func (d *database) update(i interface{}) error {
+func (d *database) update(ctx context.Context, i interface{}) error {
 	if err := validate.Struct(i); err != nil {
 		return err
 	}
-	_, err := d.dbmap.Update(i)
+	_, err := d.dbmap.WithContext(ctx).Update(i)
 	return err
 }
 
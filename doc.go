@@ -1,9 +1,13 @@
 /*
-Package maillist sends bulk e-mail to lists of addresses using
-the Sendgrid API.
+Package maillist sends bulk e-mail to lists of addresses. Delivery is
+handled by a Mailer, which uses the Sendgrid API unless another is
+configured.
 
 All functionality is implemented as methods on a session object,
 which should be closed when finished with it.
+Each method has a variant with the suffix Context (e.g.
+InsertCampaignContext) which aborts its queries once the context is
+done.
 
 The script 'init-db.sh' should be run to initialize the database for this
 package.
@@ -60,6 +64,79 @@ Create and schedule a campaign for that list.
 	s.InsertCampaign(&c, []int64{l.ID}, nil)
 
 This package will ensure the emails are sent out when the scheduled
-time is reached as long as at least one session remains open.
+time is reached as long as at least one session remains open. Any number
+of sessions, in any number of processes, may share the same database;
+each message is claimed and sent by exactly one of them.
+
+A campaign may instead recur on a cron schedule, in which case a copy
+is sent at each occurrence.
+	c.Recurrence = "CRON_TZ=Australia/Melbourne 0 9 1 * *" // 9am monthly
+	c.RecurrenceLimit = 12
+
+Setting LocalTime sends a campaign at the scheduled time of day in each
+subscriber's timezone (or their account's) rather than at one instant.
+
+New accounts can be warmed up by limiting how many messages they send each
+day, with the rest carried over to the following days. WarmupDaysRemaining
+reports how long a campaign will take under the ramp.
+	a.Warmup = "50,100,500,1000,5000"
+	days, err := s.WarmupDaysRemaining(c.ID)
+
+One-off e-mails such as password resets are sent with SendTransactional,
+ahead of any campaigns. The returned ID tracks the e-mail's delivery.
+	id, err := s.SendTransactional(&maillist.Transactional{
+		AccountID: a.ID,
+		TemplateID: resetTemplate.ID,
+		Email: "john@example.com",
+		FirstName: "John",
+		LastName: "Smith",
+	})
+	m, err := s.GetTransactional(id) // m.Status is "sent" once delivered
+
+Accounts with messages waiting take turns to send, so a large campaign
+doesn't hold up everyone else's. Account.Priority gives an account a larger
+share of the turns.
+
+Campaigns have a plain text Body and an HTMLBody, and every e-mail is sent
+as multipart/alternative with both. If only one is set, the other is
+generated from it.
+	c.HTMLBody = "<p>Hi <b>{{.FirstName}}</b></p>"
+
+The subject, preheader and bodies are Go templates, using html/template for
+the HTML body so that only it is escaped, and text/template for the rest.
+All have the fields FirstName, LastName and UnsubscribeURL, and the
+functions upper, lower, title, trim and default. Subscribers' custom
+attributes, set with SetSubscriberAttributes or Subscriber.Attributes, are
+available as Attr, and are empty for subscribers who don't have them. The
+preheader is preview text, hidden in the HTML body. Campaigns are rendered for
+a sample subscriber when they are inserted or updated, and a *TemplateError
+locating the problem is returned if any template is invalid.
+	c.Subject = "{{.FirstName}}, your tickets are ready"
+	c.Preheader = "Doors open at 7pm"
+	c.Body = "Hi {{.FirstName | default \"there\"}} from {{.Attr.company}}"
+
+Mailers
+
+Setting Config.SMTPHost delivers mail through an SMTP relay instead of
+SendGrid.
+	config.SMTPHost = "mail.example.com"
+	config.SMTPAuth = maillist.SMTPAuthPlain
+	config.SMTPUsername = "maillist"
+	config.SMTPPassword = "asdf1234"
+
+Setting Config.CaptureDir writes every e-mail to disk as a complete .eml
+file instead of sending it, which is useful for staging environments.
+	config.CaptureDir = "/var/spool/maillist"
+
+Any type implementing the Mailer interface may be set as Config.Mailer to
+deliver mail through a different provider, or to capture it in tests.
+	type myMailer struct{}
+
+	func (myMailer) Send(ctx context.Context, e *maillist.Email) error {
+		fmt.Println("sending", e.Subject, "to", e.To.Address)
+		return nil
+	}
+
+	config.Mailer = myMailer{}
 */
 package maillist
@@ -0,0 +1,195 @@
+package maillist
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultDomainLimits are the messages per minute sent to the major mailbox
+// providers when Config.DomainLimits is nil. Providers defer mail which
+// arrives faster than they expect from a sender.
+var DefaultDomainLimits = map[string]int{
+	"gmail.com":      300,
+	"googlemail.com": 300,
+	"outlook.com":    200,
+	"hotmail.com":    200,
+	"live.com":       200,
+	"msn.com":        200,
+	"yahoo.com":      150,
+	"ymail.com":      150,
+	"aol.com":        150,
+	"icloud.com":     100,
+	"me.com":         100,
+	"mac.com":        100,
+}
+
+// emailDomain returns the lower-cased domain of an e-mail address
+func emailDomain(email string) string {
+	return strings.ToLower(email[strings.LastIndex(email, "@")+1:])
+}
+
+// domainThrottle limits the rate of messages to each recipient domain, with a
+// token bucket per domain holding up to a minute's worth of messages
+type domainThrottle struct {
+	mu       sync.Mutex
+	limits   map[string]int
+	fallback int
+	buckets  map[string]*domainBucket
+}
+
+type domainBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newDomainThrottle(limits map[string]int, fallback int) *domainThrottle {
+	return &domainThrottle{limits: limits, fallback: fallback, buckets: make(map[string]*domainBucket)}
+}
+
+func (t *domainThrottle) limit(domain string) int {
+	if limit, ok := t.limits[domain]; ok {
+		return limit
+	}
+	return t.fallback
+}
+
+// bucket returns the bucket of a domain, topped up to the current time. The
+// lock must be held.
+func (t *domainThrottle) bucket(domain string, limit int, now time.Time) *domainBucket {
+	b := t.buckets[domain]
+	if b == nil {
+		b = &domainBucket{tokens: float64(limit), last: now}
+		t.buckets[domain] = b
+	}
+	b.tokens += now.Sub(b.last).Minutes() * float64(limit)
+	if b.tokens > float64(limit) {
+		b.tokens = float64(limit)
+	}
+	b.last = now
+	return b
+}
+
+// take uses up a message to a domain if one is available, and otherwise
+// returns how long until one will be
+func (t *domainThrottle) take(domain string) time.Duration {
+	if t == nil {
+		return 0
+	}
+	limit := t.limit(domain)
+	if limit <= 0 {
+		return 0
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	b := t.bucket(domain, limit, time.Now())
+	if b.tokens >= 1 {
+		b.tokens--
+		return 0
+	}
+	return time.Duration((1 - b.tokens) / float64(limit) * float64(time.Minute))
+}
+
+// refund returns a message to a domain's bucket, when a message which was
+// allowed by take won't be sent after all
+func (t *domainThrottle) refund(domain string) {
+	if t == nil {
+		return
+	}
+	limit := t.limit(domain)
+	if limit <= 0 {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if b := t.bucket(domain, limit, time.Now()); b.tokens < float64(limit) {
+		b.tokens++
+	}
+}
+
+// quotas returns how many messages may be sent now to each domain which has
+// fewer than n available, so that a claim of n messages takes no more than
+// that from those domains. Domains limited only by the fallback are included
+// once they have been sent to.
+func (t *domainThrottle) quotas(n int) map[string]int {
+	if t == nil {
+		return nil
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	quotas := make(map[string]int)
+	now := time.Now()
+	add := func(domain string) {
+		limit := t.limit(domain)
+		if limit <= 0 {
+			return
+		}
+		if available := int(t.bucket(domain, limit, now).tokens); available < n {
+			quotas[domain] = available
+		}
+	}
+	for domain := range t.limits {
+		add(domain)
+	}
+	for domain := range t.buckets {
+		if _, ok := t.limits[domain]; !ok {
+			add(domain)
+		}
+	}
+	return quotas
+}
+
+// throttle removes messages from a job which would exceed the rate limit of
+// their recipient's domain, and returns them to the queue until they may be
+// sent. This interleaves messages to busy domains with those to others.
+// Claims are already limited by domain, so this is only needed when several
+// workers claim from a domain at once, or for a domain first sent to.
+func (s *Session) throttle(ctx context.Context, j *job) error {
+	var allowed []*Message
+	waits := make(map[string]time.Duration)
+	deferred := make(map[string][]interface{})
+
+	for _, m := range j.messages {
+		wait := s.domains.take(m.Domain)
+		if wait == 0 {
+			allowed = append(allowed, m)
+			continue
+		}
+		waits[m.Domain] = wait
+		deferred[m.Domain] = append(deferred[m.Domain], m.SubscriberID)
+	}
+
+	now := time.Now()
+	for domain, ids := range deferred {
+		updateSQL := fmt.Sprintf(`
+UPDATE message
+	SET status='pending', owner='', next_attempt=?
+
+WHERE owner=?
+	AND status='sending'
+	AND subscriber_id IN (%s)`,
+			sqlPlaceholders(len(ids)))
+
+		// round up, so that the messages aren't claimed again too early
+		next := now.Add(waits[domain] + time.Second).Unix()
+		args := append([]interface{}{next, j.owner}, ids...)
+		if _, err := s.dbmap.WithContext(ctx).Exec(updateSQL, args...); err != nil {
+			return err
+		}
+	}
+
+	j.messages = allowed
+	return nil
+}
+
+// sqlPlaceholders returns a comma separated list of n query placeholders
+func sqlPlaceholders(n int) string {
+	return strings.TrimSuffix(strings.Repeat("?,", n), ",")
+}
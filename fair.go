@@ -0,0 +1,106 @@
+package maillist
+
+import (
+	"sort"
+	"sync"
+)
+
+// claimCandidate is a campaign with messages ready to be claimed
+type claimCandidate struct {
+	AccountID  int64 `db:"account_id"`
+	CampaignID int64 `db:"campaign_id"`
+	Priority   int   `db:"priority"`
+
+	Transactional bool `db:"transactional"`
+}
+
+// fairQueue chooses which campaign to claim messages from next, so that every
+// account with messages waiting takes turns in proportion to its priority, and
+// the campaigns of each account take equal turns. It is a stride scheduler:
+// each turn advances an account's pass by the inverse of its priority, and the
+// account with the lowest pass goes next. Ties go to the lowest ID, so the
+// order is deterministic.
+type fairQueue struct {
+	mu        sync.Mutex
+	accounts  map[int64]float64
+	campaigns map[int64]float64
+}
+
+func newFairQueue() *fairQueue {
+	return &fairQueue{accounts: make(map[int64]float64), campaigns: make(map[int64]float64)}
+}
+
+// next chooses the next candidate and takes its turn. Accounts and campaigns
+// which had nothing waiting are forgotten, and start their next turn level
+// with the others rather than catching up on the turns they missed.
+// Transactional e-mails go first, oldest first, without taking a turn.
+func (q *fairQueue) next(cs []*claimCandidate) *claimCandidate {
+	if len(cs) == 0 {
+		return nil
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	sort.Slice(cs, func(i, j int) bool { return cs[i].CampaignID < cs[j].CampaignID })
+	for _, c := range cs {
+		if c.Transactional {
+			return c
+		}
+	}
+
+	// new accounts start level with the furthest behind of the others, and
+	// new campaigns with the furthest behind of their account's
+	var min float64
+	known := false
+	accounts := make(map[int64]float64)
+	campaigns := make(map[int64]float64)
+	campaignMin := make(map[int64]float64)
+	for _, c := range cs {
+		if pass, ok := q.accounts[c.AccountID]; ok {
+			accounts[c.AccountID] = pass
+			if !known || pass < min {
+				min, known = pass, true
+			}
+		}
+		if pass, ok := q.campaigns[c.CampaignID]; ok {
+			campaigns[c.CampaignID] = pass
+			if m, ok := campaignMin[c.AccountID]; !ok || pass < m {
+				campaignMin[c.AccountID] = pass
+			}
+		}
+	}
+	for _, c := range cs {
+		if _, ok := accounts[c.AccountID]; !ok {
+			accounts[c.AccountID] = min
+		}
+		if _, ok := campaigns[c.CampaignID]; !ok {
+			campaigns[c.CampaignID] = campaignMin[c.AccountID]
+		}
+	}
+
+	var best *claimCandidate
+	for _, c := range cs {
+		if best == nil {
+			best = c
+			continue
+		}
+		a, b := accounts[c.AccountID], accounts[best.AccountID]
+		switch {
+		case a < b, a == b && c.AccountID < best.AccountID:
+			best = c
+		case c.AccountID == best.AccountID && campaigns[c.CampaignID] < campaigns[best.CampaignID]:
+			best = c
+		}
+	}
+
+	priority := best.Priority
+	if priority < 1 {
+		priority = 1
+	}
+	accounts[best.AccountID] += 1 / float64(priority)
+	campaigns[best.CampaignID]++
+
+	q.accounts, q.campaigns = accounts, campaigns
+	return best
+}
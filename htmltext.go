@@ -0,0 +1,158 @@
+package maillist
+
+import (
+	"html"
+	"strings"
+)
+
+// paragraphTags are the HTML elements which are separated from the rest of
+// the text by a blank line, and blockTags those which begin a new line
+var (
+	paragraphTags = map[string]bool{
+		"blockquote": true, "h1": true, "h2": true, "h3": true, "h4": true,
+		"h5": true, "h6": true, "ol": true, "p": true, "pre": true,
+		"table": true, "ul": true,
+	}
+	blockTags = map[string]bool{
+		"address": true, "article": true, "br": true, "div": true,
+		"footer": true, "header": true, "hr": true, "li": true,
+		"section": true, "tr": true,
+	}
+)
+
+// htmlToText generates a plain text alternative to an HTML body. Tags are
+// removed, with block elements on their own lines and links followed by their
+// address in brackets. The contents of the head, and of scripts and styles,
+// are dropped.
+func htmlToText(s string) string {
+	var text, line strings.Builder
+	var href string
+	skip := ""
+	blank := true
+
+	// newline ends the current line, leaving at most one blank line
+	newline := func(paragraph bool) {
+		l := strings.Join(strings.Fields(line.String()), " ")
+		line.Reset()
+		if l != "" {
+			text.WriteString(l)
+			text.WriteString("\n")
+			blank = false
+		}
+		if paragraph && !blank {
+			text.WriteString("\n")
+			blank = true
+		}
+	}
+
+	for len(s) > 0 {
+		i := strings.Index(s, "<")
+		if i < 0 {
+			i = len(s)
+		}
+		if skip == "" {
+			line.WriteString(html.UnescapeString(s[:i]))
+		}
+		s = s[i:]
+		if s == "" {
+			break
+		}
+
+		if strings.HasPrefix(s, "<!--") {
+			if end := strings.Index(s, "-->"); end >= 0 {
+				s = s[end+3:]
+			} else {
+				s = ""
+			}
+			continue
+		}
+
+		end := strings.Index(s, ">")
+		if end < 0 {
+			break
+		}
+		tag := s[1:end]
+		s = s[end+1:]
+
+		closing := strings.HasPrefix(tag, "/")
+		name := strings.ToLower(strings.TrimLeft(tag, "/"))
+		if j := strings.IndexAny(name, " \t\r\n/"); j >= 0 {
+			name = name[:j]
+		}
+
+		if skip != "" {
+			if closing && name == skip {
+				skip = ""
+			}
+			continue
+		}
+
+		switch {
+		case name == "head" || name == "script" || name == "style" || name == "title":
+			if !closing {
+				skip = name
+			}
+
+		case name == "a" && !closing:
+			href = attribute(tag, "href")
+
+		case name == "a" && closing:
+			if href != "" && !strings.HasPrefix(href, "#") && !strings.Contains(line.String(), href) {
+				line.WriteString(" (" + href + ")")
+			}
+			href = ""
+
+		case name == "li" && !closing:
+			newline(false)
+			line.WriteString("* ")
+
+		case paragraphTags[name]:
+			newline(true)
+
+		case blockTags[name]:
+			newline(false)
+
+		case name == "td" || name == "th":
+			line.WriteString(" ")
+		}
+	}
+	newline(false)
+	return strings.TrimSpace(text.String())
+}
+
+// attribute returns the value of an attribute of an HTML start tag
+func attribute(tag, name string) string {
+	lower := strings.ToLower(tag)
+	i := strings.Index(lower, " "+name+"=")
+	if i < 0 {
+		return ""
+	}
+	value := tag[i+len(name)+2:]
+	if value != "" && (value[0] == '"' || value[0] == '\'') {
+		if end := strings.IndexByte(value[1:], value[0]); end >= 0 {
+			return html.UnescapeString(value[1 : end+1])
+		}
+		return ""
+	}
+	if end := strings.IndexAny(value, " \t\r\n>"); end >= 0 {
+		value = value[:end]
+	}
+	return html.UnescapeString(value)
+}
+
+// textToHTML formats a plain text body as HTML, with a paragraph for each
+// block of lines separated by a blank line
+func textToHTML(s string) string {
+	var b strings.Builder
+	for _, p := range strings.Split(strings.Replace(s, "\r\n", "\n", -1), "\n\n") {
+		if p = strings.TrimSpace(p); p == "" {
+			continue
+		}
+		lines := strings.Split(p, "\n")
+		for i := range lines {
+			lines[i] = html.EscapeString(lines[i])
+		}
+		b.WriteString("<p>" + strings.Join(lines, "<br>\n") + "</p>\n")
+	}
+	return b.String()
+}
@@ -0,0 +1,81 @@
+package maillist
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// schedulerLease is the name of the lease held by the session responsible for
+// expanding due campaigns into messages
+const schedulerLease = "scheduler"
+
+// acquireLease takes the named lease for this session if it is free or has
+// expired, or renews it if already held. It returns whether the session holds
+// the lease.
+func (s *Session) acquireLease(ctx context.Context, name string, d time.Duration) (bool, error) {
+	db := s.dbmap.WithContext(ctx)
+	now := time.Now()
+
+	// assignments are evaluated left to right, so expires is only updated
+	// if owner was
+	upsertSQL := `
+INSERT INTO lease
+	(name, owner, expires)
+
+VALUES
+	(?, ?, ?)
+
+ON DUPLICATE KEY UPDATE
+	owner=IF(expires<? OR owner=VALUES(owner), VALUES(owner), owner),
+	expires=IF(owner=VALUES(owner), VALUES(expires), expires)`
+
+	if _, err := db.Exec(upsertSQL, name, s.id, now.Add(d).Unix(), now.Unix()); err != nil {
+		return false, err
+	}
+
+	owner, err := db.SelectStr("SELECT owner FROM lease WHERE name=?", name)
+	if err != nil {
+		return false, err
+	}
+	return owner == s.id, nil
+}
+
+// releaseLease gives up the named lease if this session holds it, so another
+// session can take over without waiting for it to expire
+func (s *Session) releaseLease(ctx context.Context, name string) error {
+	_, err := s.dbmap.WithContext(ctx).Exec("DELETE FROM lease WHERE name=? AND owner=?", name, s.id)
+	return err
+}
+
+// InstanceID returns the identifier of this session, which is unique across
+// all sessions sharing the database
+func (s *Session) InstanceID() string {
+	return s.id
+}
+
+// Leader returns the instance ID of the session currently responsible for
+// scheduling campaigns, or ErrNotFound if no session holds the role (e.g.
+// because the previous leader exited and none has yet taken over).
+func (s *Session) Leader() (string, error) {
+	return s.LeaderContext(context.Background())
+}
+
+// LeaderContext is like Leader but with a context
+func (s *Session) LeaderContext(ctx context.Context) (string, error) {
+	selectSQL := `
+SELECT owner
+	FROM lease
+
+WHERE name=?
+	AND expires>=?`
+
+	owner, err := s.dbmap.WithContext(ctx).SelectStr(selectSQL, schedulerLease, time.Now().Unix())
+	if err == sql.ErrNoRows || (err == nil && owner == "") {
+		return "", ErrNotFound
+
+	} else if err != nil {
+		return "", err
+	}
+	return owner, nil
+}
@@ -1,6 +1,7 @@
 package maillist
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 )
@@ -24,6 +25,11 @@ type ListSubscriber struct {
 
 // GetLists retrieves all the mailing lists associated with an account.
 func (s *Session) GetLists(accountID int64) ([]*List, error) {
+	return s.GetListsContext(context.Background(), accountID)
+}
+
+// GetListsContext is like GetLists but with a context
+func (s *Session) GetListsContext(ctx context.Context, accountID int64) ([]*List, error) {
 
 	selectSQL := fmt.Sprintf(`
 SELECT %s
@@ -34,7 +40,7 @@ WHERE status!='deleted'
 		s.selectString(&List{}))
 
 	var ls []*List
-	if _, err := s.dbmap.Select(&ls, selectSQL, accountID); err != nil {
+	if _, err := s.dbmap.WithContext(ctx).Select(&ls, selectSQL, accountID); err != nil {
 		return nil, err
 
 	} else if len(ls) == 0 {
@@ -46,14 +52,24 @@ WHERE status!='deleted'
 
 // InsertList adds a new mailing list to the database.
 func (s *Session) InsertList(l *List) error {
+	return s.InsertListContext(context.Background(), l)
+}
+
+// InsertListContext is like InsertList but with a context
+func (s *Session) InsertListContext(ctx context.Context, l *List) error {
 	if l.Status == "" {
 		l.Status = statusActive
 	}
-	return s.insert(l)
+	return s.insert(ctx, l)
 }
 
 // GetList retrieves a mailing list with a given ID
 func (s *Session) GetList(listID int64) (*List, error) {
+	return s.GetListContext(context.Background(), listID)
+}
+
+// GetListContext is like GetList but with a context
+func (s *Session) GetListContext(ctx context.Context, listID int64) (*List, error) {
 
 	query := fmt.Sprintf(`
 SELECT %s
@@ -64,7 +80,7 @@ WHERE status!='deleted'
 		s.selectString(List{}))
 
 	var l List
-	if err := s.dbmap.SelectOne(&l, query, listID); err == sql.ErrNoRows {
+	if err := s.dbmap.WithContext(ctx).SelectOne(&l, query, listID); err == sql.ErrNoRows {
 		return nil, ErrNotFound
 
 	} else if err != nil {
@@ -75,18 +91,33 @@ WHERE status!='deleted'
 
 // UpdateList updates a mailing list in the database, identified by it's ID
 func (s *Session) UpdateList(l *List) error {
-	return s.update(l)
+	return s.UpdateListContext(context.Background(), l)
+}
+
+// UpdateListContext is like UpdateList but with a context
+func (s *Session) UpdateListContext(ctx context.Context, l *List) error {
+	return s.update(ctx, l)
 }
 
 // DeleteList removes a mailing list from the database (actually just marks it
 // as `deleted` so we can a log of it)
 func (s *Session) DeleteList(listID int64) error {
-	return s.delete(List{}, listID)
+	return s.DeleteListContext(context.Background(), listID)
+}
+
+// DeleteListContext is like DeleteList but with a context
+func (s *Session) DeleteListContext(ctx context.Context, listID int64) error {
+	return s.delete(ctx, List{}, listID)
 }
 
 // AddSubscriberToList adds a subscriber to a mailing list. Internally it is
 // added to the list_subscriber joining table
 func (s *Session) AddSubscriberToList(listID, subscriberID int64) error {
+	return s.AddSubscriberToListContext(context.Background(), listID, subscriberID)
+}
+
+// AddSubscriberToListContext is like AddSubscriberToList but with a context
+func (s *Session) AddSubscriberToListContext(ctx context.Context, listID, subscriberID int64) error {
 
 	query := `
 SELECT account_id
@@ -95,7 +126,7 @@ SELECT account_id
 WHERE status!='deleted'
 	AND id=?`
 
-	listAccountID, err := s.dbmap.SelectInt(query, listID)
+	listAccountID, err := s.dbmap.WithContext(ctx).SelectInt(query, listID)
 	if err != nil {
 		return err
 	}
@@ -104,7 +135,7 @@ WHERE status!='deleted'
 			listID)
 	}
 
-	subscriberAccountID, err := s.dbmap.SelectInt(`
+	subscriberAccountID, err := s.dbmap.WithContext(ctx).SelectInt(`
 SELECT account_id
 	FROM subscriber
 
@@ -129,12 +160,18 @@ WHERE status!='deleted'
 		SubscriberID: subscriberID,
 	}
 
-	return s.insert(&ls)
+	return s.insert(ctx, &ls)
 }
 
 // RemoveSubscriberFromList removes a subscriber from a list. Note this is
 // distinct from unsubscribing which is done on an account basis
 func (s *Session) RemoveSubscriberFromList(listID, subscriberID int64) error {
+	return s.RemoveSubscriberFromListContext(context.Background(), listID, subscriberID)
+}
+
+// RemoveSubscriberFromListContext is like RemoveSubscriberFromList but with a
+// context
+func (s *Session) RemoveSubscriberFromListContext(ctx context.Context, listID, subscriberID int64) error {
 
 	query := `
 DELETE FROM list_subscriber
@@ -142,6 +179,6 @@ DELETE FROM list_subscriber
 WHERE list_id=?
 	AND subscriber_id=?`
 
-	_, err := s.dbmap.Exec(query, listID, subscriberID)
+	_, err := s.dbmap.WithContext(ctx).Exec(query, listID, subscriberID)
 	return err
 }
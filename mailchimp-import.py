@@ -6,6 +6,11 @@ import io
 import pymysql
 import datetime
 
+# Columns after email, first name and last name are imported as subscriber
+# attributes, named by the command line arguments, e.g.
+#   ./mailchimp-import.py company city < list.csv
+attributenames = sys.argv[1:]
+
 accountemail = "sendgrid@eventarc.com"
 listname = 'imported-list ' + datetime.datetime.now().strftime('%Y-%m-%d %H:%M:%S')
 
@@ -32,6 +37,11 @@ with io.TextIOWrapper(sys.stdin.buffer, encoding='latin_1') as csvfile:
             cur.execute("insert into subscriber (account_id, first_name, last_name, email, status) values (%s, %s, %s, %s, %s)",
                     (accountid, firstname, lastname, email, 'active'))
             subscriberid = cur.lastrowid
+        for name, value in zip(attributenames, row[3:]):
+            if value == '':
+                continue
+            cur.execute("insert into subscriber_attribute (subscriber_id, name, value) values (%s, %s, %s) on duplicate key update value=values(value)",
+                    (subscriberid, name, value))
         cur.execute("insert into list_subscriber (list_id, subscriber_id, status) values (%s, %s, %s)",
                 (listid, subscriberid, 'active'))
         conn.commit()
@@ -0,0 +1,159 @@
+package maillist
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"time"
+)
+
+// Address is an e-mail address with an optional display name
+type Address struct {
+	Name    string
+	Address string
+}
+
+// Email is a single outgoing e-mail, independent of the provider used to
+// deliver it. Body is the plain text content, and HTML, if set, the
+// equivalent HTML, in which case the e-mail is sent as multipart/alternative.
+type Email struct {
+	From    Address
+	To      Address
+	Subject string
+	Body    string
+	HTML    string
+}
+
+// Mailer delivers e-mails on behalf of a session. Config.Mailer may be set to
+// any implementation; otherwise SendGrid is used. Send should give up and
+// return an error once the context is done.
+type Mailer interface {
+	Send(ctx context.Context, e *Email) error
+}
+
+// PermanentError wraps an error which retrying will not resolve, such as a
+// rejected recipient. Mailers should return one so that the message is marked
+// failed immediately rather than being retried.
+type PermanentError struct {
+	Err error
+}
+
+func (e *PermanentError) Error() string {
+	return e.Err.Error()
+}
+
+// Batch is a group of e-mails with the same sender and content, which can be
+// sent in a single request. Each occurrence of a substitution key in the
+// subject or either body is replaced with the recipient's value.
+type Batch struct {
+	From       Address
+	Subject    string
+	Body       string
+	HTML       string
+	Recipients []Recipient
+}
+
+// Recipient is a single destination of a batch
+type Recipient struct {
+	To            Address
+	Substitutions map[string]string
+}
+
+// BatchMailer is implemented by mailers which can send many e-mails in one
+// request. Batches never contain more than maxBatch recipients.
+type BatchMailer interface {
+	Mailer
+	SendBatch(ctx context.Context, b *Batch) error
+}
+
+// idleCloser is implemented by mailers which keep connections open between
+// messages. CloseIdleConnections is called whenever the queue of pending
+// messages has been drained.
+type idleCloser interface {
+	CloseIdleConnections()
+}
+
+// printMailer writes e-mails to the session's logger instead of sending them.
+// It is used when Config.JustPrint is set.
+type printMailer struct {
+	s *Session
+}
+
+func (m printMailer) Send(ctx context.Context, e *Email) error {
+	m.s.info(string(printEmail(e)))
+	return nil
+}
+
+// printEmail just prints an email to stderr. It is useful for
+// debugging/logging
+func printEmail(e *Email) []byte {
+	s := fmt.Sprintln("Email to send")
+	s += fmt.Sprintf("To: %s (%s)\n", e.To.Address, e.To.Name)
+	s += fmt.Sprintf("From: %s (%s)\n", e.From.Address, e.From.Name)
+	s += fmt.Sprintf("Subject: %s\nBody: %s\n", e.Subject, e.Body)
+	return []byte(s)
+}
+
+// formatEmail renders an e-mail as an RFC 5322 message, suitable for sending
+// over SMTP or saving to disk
+func formatEmail(e *Email, date time.Time) []byte {
+	var buf bytes.Buffer
+	from := mail.Address{Name: e.From.Name, Address: e.From.Address}
+	to := mail.Address{Name: e.To.Name, Address: e.To.Address}
+
+	fmt.Fprintf(&buf, "From: %s\r\n", from.String())
+	fmt.Fprintf(&buf, "To: %s\r\n", to.String())
+	fmt.Fprintf(&buf, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", e.Subject))
+	fmt.Fprintf(&buf, "Date: %s\r\n", date.Format(time.RFC1123Z))
+	fmt.Fprintf(&buf, "Message-ID: %s\r\n", messageID(e.From.Address))
+	fmt.Fprintf(&buf, "MIME-Version: 1.0\r\n")
+
+	if e.HTML == "" {
+		fmt.Fprintf(&buf, "Content-Type: text/plain; charset=utf-8\r\n")
+		fmt.Fprintf(&buf, "Content-Transfer-Encoding: quoted-printable\r\n\r\n")
+
+		w := quotedprintable.NewWriter(&buf)
+		w.Write([]byte(e.Body))
+		w.Close()
+		return buf.Bytes()
+	}
+
+	mw := multipart.NewWriter(&buf)
+	fmt.Fprintf(&buf, "Content-Type: multipart/alternative; boundary=%s\r\n\r\n", mw.Boundary())
+
+	// the preferred alternative comes last
+	for _, part := range []struct{ contentType, body string }{
+		{"text/plain", e.Body},
+		{"text/html", e.HTML},
+	} {
+		header := textproto.MIMEHeader{}
+		header.Set("Content-Type", part.contentType+"; charset=utf-8")
+		header.Set("Content-Transfer-Encoding", "quoted-printable")
+		w, _ := mw.CreatePart(header)
+		qw := quotedprintable.NewWriter(w)
+		qw.Write([]byte(part.body))
+		qw.Close()
+	}
+	mw.Close()
+	return buf.Bytes()
+}
+
+// messageID generates a unique Message-ID header value in the domain of the
+// sender
+func messageID(from string) string {
+	domain := "localhost"
+	if i := strings.LastIndex(from, "@"); i >= 0 {
+		domain = from[i+1:]
+	}
+	var buf [16]byte
+	rand.Read(buf[:])
+	return fmt.Sprintf("<%s@%s>", hex.EncodeToString(buf[:]), domain)
+}
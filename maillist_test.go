@@ -2,8 +2,13 @@ package maillist_test
 
 import (
 	"bytes"
+	"context"
+	"database/sql"
+	"errors"
 	"fmt"
 	"os"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -710,6 +715,2739 @@ func TestAccounts(t *testing.T) {
 	}
 }
 
+type chanMailer chan *maillist.Email
+
+func (m chanMailer) Send(ctx context.Context, e *maillist.Email) error {
+	m <- e
+	return nil
+}
+
+func TestMailer(t *testing.T) {
+	var (
+		err error
+		s   *maillist.Session
+	)
+
+	mailer := make(chanMailer, 1)
+	config := maillist.Config{
+		DatabaseAddress: os.Getenv("MAILLIST_DATABASE"),
+		UnsubscribeURL:  "https://myeventarc.localhost/unsubscribe",
+		Mailer:          mailer,
+	}
+
+	if s, err = maillist.OpenSession(&config); err != nil {
+		t.Fatalf("Could not open session: %v", err)
+	}
+	defer s.Close()
+
+	a := maillist.Account{
+		ApplicationID: 0xdead000a,
+		FirstName:     "Test",
+		LastName:      "Mailer",
+		Email:         "testmailer@example.com",
+	}
+	if err = s.InsertAccount(&a); err != nil {
+		t.Fatalf("Could not insert account: %v\n", err)
+	}
+	defer s.DeleteAccount(a.ID)
+
+	l := maillist.List{
+		AccountID: a.ID,
+		Name:      "TestMailer",
+	}
+	if err = s.InsertList(&l); err != nil {
+		t.Fatalf("Could not insert list: %v\n", err)
+	}
+	defer s.DeleteList(l.ID)
+
+	sub := maillist.Subscriber{
+		AccountID: a.ID,
+		FirstName: "Mary",
+		LastName:  "Mailer",
+		Email:     "mary.mailer@example.com",
+	}
+	if err = s.InsertSubscriber(&sub); err != nil {
+		t.Fatalf("Could not insert subscriber: %v\n", err)
+	}
+	defer s.DeleteSubscriber(sub.ID)
+
+	if err = s.AddSubscriberToList(l.ID, sub.ID); err != nil {
+		t.Fatalf("Could not add subscriber to list: %v\n", err)
+	}
+
+	c := maillist.Campaign{
+		AccountID: a.ID,
+		Subject:   "TestMailer",
+		Body:      "Hi {{.FirstName}}",
+		Address:   "123 fake st",
+		Scheduled: time.Now().Unix(),
+	}
+	if err = s.InsertCampaign(&c, []int64{l.ID}, nil); err != nil {
+		t.Fatalf("Could not insert campaign: %v\n", err)
+	}
+
+	select {
+	case e := <-mailer:
+		if e.To.Address != sub.Email || e.From.Address != a.Email || e.Body != "Hi Mary" {
+			t.Errorf("unexpected email: %+v", e)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for email")
+	}
+}
+
+type batchMailer struct {
+	chanMailer
+	batches chan *maillist.Batch
+}
+
+func (m batchMailer) SendBatch(ctx context.Context, b *maillist.Batch) error {
+	m.batches <- b
+	return nil
+}
+
+func TestBatchMailer(t *testing.T) {
+	var (
+		err error
+		s   *maillist.Session
+	)
+
+	mailer := batchMailer{make(chanMailer, 1), make(chan *maillist.Batch, 1)}
+	config := maillist.Config{
+		DatabaseAddress: os.Getenv("MAILLIST_DATABASE"),
+		UnsubscribeURL:  "https://myeventarc.localhost/unsubscribe",
+		Mailer:          mailer,
+	}
+
+	if s, err = maillist.OpenSession(&config); err != nil {
+		t.Fatalf("Could not open session: %v", err)
+	}
+	defer s.Close()
+
+	a := maillist.Account{
+		ApplicationID: 0xdead000b,
+		FirstName:     "Test",
+		LastName:      "BatchMailer",
+		Email:         "testbatchmailer@example.com",
+	}
+	if err = s.InsertAccount(&a); err != nil {
+		t.Fatalf("Could not insert account: %v\n", err)
+	}
+	defer s.DeleteAccount(a.ID)
+
+	l := maillist.List{
+		AccountID: a.ID,
+		Name:      "TestBatchMailer",
+	}
+	if err = s.InsertList(&l); err != nil {
+		t.Fatalf("Could not insert list: %v\n", err)
+	}
+	defer s.DeleteList(l.ID)
+
+	for _, name := range []string{"Alice", "Bob"} {
+		sub := maillist.Subscriber{
+			AccountID: a.ID,
+			FirstName: name,
+			LastName:  "Batch",
+			Email:     name + ".batch@example.com",
+		}
+		if err = s.InsertSubscriber(&sub); err != nil {
+			t.Fatalf("Could not insert subscriber: %v\n", err)
+		}
+		defer s.DeleteSubscriber(sub.ID)
+
+		if err = s.AddSubscriberToList(l.ID, sub.ID); err != nil {
+			t.Fatalf("Could not add subscriber to list: %v\n", err)
+		}
+	}
+
+	c := maillist.Campaign{
+		AccountID: a.ID,
+		Subject:   "TestBatchMailer",
+		Body:      "Hi {{.FirstName}}",
+		Address:   "123 fake st",
+		Scheduled: time.Now().Unix(),
+	}
+	if err = s.InsertCampaign(&c, []int64{l.ID}, nil); err != nil {
+		t.Fatalf("Could not insert campaign: %v\n", err)
+	}
+
+	select {
+	case b := <-mailer.batches:
+		if len(b.Recipients) != 2 {
+			t.Fatalf("got %d recipients in batch, want 2", len(b.Recipients))
+		}
+		if b.Body != "Hi -FirstName-" {
+			t.Errorf("got batch body '%s', want 'Hi -FirstName-'", b.Body)
+		}
+		for _, r := range b.Recipients {
+			if name := r.Substitutions["-FirstName-"]; r.To.Address != name+".batch@example.com" {
+				t.Errorf("got substitution '%s' for %s", name, r.To.Address)
+			}
+		}
+	case e := <-mailer.chanMailer:
+		t.Fatalf("email sent individually rather than in a batch: %+v", e)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for batch")
+	}
+}
+
+type failMailer struct{}
+
+func (failMailer) Send(ctx context.Context, e *maillist.Email) error {
+	return &maillist.PermanentError{Err: errors.New("recipient rejected")}
+}
+
+func TestPermanentFailure(t *testing.T) {
+	var (
+		err error
+		s   *maillist.Session
+		buf logger
+	)
+
+	config := maillist.Config{
+		DatabaseAddress: os.Getenv("MAILLIST_DATABASE"),
+		Logger:          &buf,
+		UnsubscribeURL:  "https://myeventarc.localhost/unsubscribe",
+		Mailer:          failMailer{},
+	}
+
+	if s, err = maillist.OpenSession(&config); err != nil {
+		t.Fatalf("Could not open session: %v", err)
+	}
+	defer s.Close()
+
+	a := maillist.Account{
+		ApplicationID: 0xdead000c,
+		FirstName:     "Test",
+		LastName:      "PermanentFailure",
+		Email:         "testpermanentfailure@example.com",
+	}
+	if err = s.InsertAccount(&a); err != nil {
+		t.Fatalf("Could not insert account: %v\n", err)
+	}
+	defer s.DeleteAccount(a.ID)
+
+	l := maillist.List{
+		AccountID: a.ID,
+		Name:      "TestPermanentFailure",
+	}
+	if err = s.InsertList(&l); err != nil {
+		t.Fatalf("Could not insert list: %v\n", err)
+	}
+	defer s.DeleteList(l.ID)
+
+	sub := maillist.Subscriber{
+		AccountID: a.ID,
+		FirstName: "Rejected",
+		LastName:  "Recipient",
+		Email:     "rejected@example.com",
+	}
+	if err = s.InsertSubscriber(&sub); err != nil {
+		t.Fatalf("Could not insert subscriber: %v\n", err)
+	}
+	defer s.DeleteSubscriber(sub.ID)
+
+	if err = s.AddSubscriberToList(l.ID, sub.ID); err != nil {
+		t.Fatalf("Could not add subscriber to list: %v\n", err)
+	}
+
+	c := maillist.Campaign{
+		AccountID: a.ID,
+		Subject:   "TestPermanentFailure",
+		Body:      "Hi {{.FirstName}}",
+		Address:   "123 fake st",
+		Scheduled: time.Now().Unix(),
+	}
+	if err = s.InsertCampaign(&c, []int64{l.ID}, nil); err != nil {
+		t.Fatalf("Could not insert campaign: %v\n", err)
+	}
+	time.Sleep(5 * time.Second)
+
+	if c2, err := s.GetCampaign(c.ID); err != nil {
+		t.Fatalf("Could not get campaign: %v\n", err)
+	} else if c2.Status != "failed" {
+		t.Errorf("got campaign status '%s', want 'failed'", c2.Status)
+	}
+}
+
+func TestLeader(t *testing.T) {
+	config := maillist.Config{
+		DatabaseAddress: os.Getenv("MAILLIST_DATABASE"),
+		UnsubscribeURL:  "https://myeventarc.localhost/unsubscribe",
+		JustPrint:       true,
+	}
+
+	s1, err := maillist.OpenSession(&config)
+	if err != nil {
+		t.Fatalf("Could not open session: %v", err)
+	}
+	time.Sleep(time.Second)
+
+	s2, err := maillist.OpenSession(&config)
+	if err != nil {
+		t.Fatalf("Could not open session: %v", err)
+	}
+	defer s2.Close()
+	time.Sleep(time.Second)
+
+	if s1.InstanceID() == s2.InstanceID() {
+		t.Fatal("sessions should have different instance IDs")
+	}
+
+	if leader, err := s2.Leader(); err != nil || leader != s1.InstanceID() {
+		t.Errorf("got leader %s (%v), want %s", leader, err, s1.InstanceID())
+	}
+
+	if err = s1.Close(); err != nil {
+		t.Fatalf("Could not close session: %v", err)
+	}
+
+	if leader, err := s2.Leader(); err != maillist.ErrNotFound {
+		t.Errorf("got leader %s (%v), want none after leader closed", leader, err)
+	}
+}
+
+// blockMailer signals when it starts sending, then waits to be released
+type blockMailer struct {
+	started, release chan struct{}
+}
+
+func (m blockMailer) Send(ctx context.Context, e *maillist.Email) error {
+	m.started <- struct{}{}
+	<-m.release
+	return nil
+}
+
+func TestShutdown(t *testing.T) {
+	var (
+		err error
+		s   *maillist.Session
+	)
+
+	mailer := blockMailer{make(chan struct{}, 1), make(chan struct{})}
+	config := maillist.Config{
+		DatabaseAddress: os.Getenv("MAILLIST_DATABASE"),
+		UnsubscribeURL:  "https://myeventarc.localhost/unsubscribe",
+		Mailer:          mailer,
+	}
+
+	if s, err = maillist.OpenSession(&config); err != nil {
+		t.Fatalf("Could not open session: %v", err)
+	}
+
+	a := maillist.Account{
+		ApplicationID: 0xdead000d,
+		FirstName:     "Test",
+		LastName:      "Shutdown",
+		Email:         "testshutdown@example.com",
+	}
+	if err = s.InsertAccount(&a); err != nil {
+		t.Fatalf("Could not insert account: %v\n", err)
+	}
+
+	l := maillist.List{
+		AccountID: a.ID,
+		Name:      "TestShutdown",
+	}
+	if err = s.InsertList(&l); err != nil {
+		t.Fatalf("Could not insert list: %v\n", err)
+	}
+
+	sub := maillist.Subscriber{
+		AccountID: a.ID,
+		FirstName: "Sam",
+		LastName:  "Shutdown",
+		Email:     "sam.shutdown@example.com",
+	}
+	if err = s.InsertSubscriber(&sub); err != nil {
+		t.Fatalf("Could not insert subscriber: %v\n", err)
+	}
+
+	if err = s.AddSubscriberToList(l.ID, sub.ID); err != nil {
+		t.Fatalf("Could not add subscriber to list: %v\n", err)
+	}
+
+	c := maillist.Campaign{
+		AccountID: a.ID,
+		Subject:   "TestShutdown",
+		Body:      "Hi {{.FirstName}}",
+		Address:   "123 fake st",
+		Scheduled: time.Now().Unix(),
+	}
+	if err = s.InsertCampaign(&c, []int64{l.ID}, nil); err != nil {
+		t.Fatalf("Could not insert campaign: %v\n", err)
+	}
+
+	select {
+	case <-mailer.started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for send")
+	}
+
+	closed := make(chan error)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		closed <- s.Shutdown(ctx)
+	}()
+
+	select {
+	case err = <-closed:
+		t.Fatalf("Shutdown returned %v while a message was being sent", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	close(mailer.release)
+	if err = <-closed; err != nil {
+		t.Fatalf("Could not shut down session: %v", err)
+	}
+
+	config.Mailer = nil
+	config.JustPrint = true
+	if s, err = maillist.OpenSession(&config); err != nil {
+		t.Fatalf("Could not open session: %v", err)
+	}
+	defer s.Close()
+	defer s.DeleteAccount(a.ID)
+	defer s.DeleteList(l.ID)
+	defer s.DeleteSubscriber(sub.ID)
+
+	if c2, err := s.GetCampaign(c.ID); err != nil {
+		t.Fatalf("Could not get campaign: %v\n", err)
+	} else if c2.Status != "sent" {
+		t.Errorf("got campaign status '%s', want 'sent'", c2.Status)
+	}
+}
+
+func TestScheduler(t *testing.T) {
+	var (
+		err error
+		s   *maillist.Session
+	)
+
+	mailer := make(chanMailer, 1)
+	config := maillist.Config{
+		DatabaseAddress: os.Getenv("MAILLIST_DATABASE"),
+		UnsubscribeURL:  "https://myeventarc.localhost/unsubscribe",
+		Mailer:          mailer,
+		PollInterval:    time.Hour,
+	}
+
+	if s, err = maillist.OpenSession(&config); err != nil {
+		t.Fatalf("Could not open session: %v", err)
+	}
+	defer s.Close()
+
+	a := maillist.Account{
+		ApplicationID: 0xdead000e,
+		FirstName:     "Test",
+		LastName:      "Scheduler",
+		Email:         "testscheduler@example.com",
+	}
+	if err = s.InsertAccount(&a); err != nil {
+		t.Fatalf("Could not insert account: %v\n", err)
+	}
+	defer s.DeleteAccount(a.ID)
+
+	l := maillist.List{
+		AccountID: a.ID,
+		Name:      "TestScheduler",
+	}
+	if err = s.InsertList(&l); err != nil {
+		t.Fatalf("Could not insert list: %v\n", err)
+	}
+	defer s.DeleteList(l.ID)
+
+	sub := maillist.Subscriber{
+		AccountID: a.ID,
+		FirstName: "Sally",
+		LastName:  "Scheduler",
+		Email:     "sally.scheduler@example.com",
+	}
+	if err = s.InsertSubscriber(&sub); err != nil {
+		t.Fatalf("Could not insert subscriber: %v\n", err)
+	}
+	defer s.DeleteSubscriber(sub.ID)
+
+	if err = s.AddSubscriberToList(l.ID, sub.ID); err != nil {
+		t.Fatalf("Could not add subscriber to list: %v\n", err)
+	}
+
+	c := maillist.Campaign{
+		AccountID: a.ID,
+		Subject:   "TestScheduler",
+		Body:      "Hi {{.FirstName}}",
+		Address:   "123 fake st",
+		Scheduled: time.Now().Add(time.Hour).Unix(),
+	}
+	if err = s.InsertCampaign(&c, []int64{l.ID}, nil); err != nil {
+		t.Fatalf("Could not insert campaign: %v\n", err)
+	}
+
+	select {
+	case e := <-mailer:
+		t.Fatalf("campaign sent early: %+v", e)
+	case <-time.After(time.Second):
+	}
+
+	// rescheduling re-arms the timer, rather than waiting for the next poll
+	c.Scheduled = time.Now().Add(2 * time.Second).Unix()
+	if err = s.UpdateCampaign(&c); err != nil {
+		t.Fatalf("Could not update campaign: %v\n", err)
+	}
+
+	select {
+	case e := <-mailer:
+		if e.To.Address != sub.Email {
+			t.Errorf("unexpected email: %+v", e)
+		}
+		if now := time.Now().Unix(); now < c.Scheduled {
+			t.Errorf("campaign sent at %d, before it was scheduled at %d", now, c.Scheduled)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for email")
+	}
+
+	c.Subject = "Too late"
+	if err = s.UpdateCampaign(&c); err == nil {
+		t.Error("updated a campaign which has already been sent")
+	}
+}
+
+func TestInsertCampaignWhileSending(t *testing.T) {
+	var (
+		err error
+		s   *maillist.Session
+	)
+
+	mailer := blockMailer{make(chan struct{}, 1), make(chan struct{})}
+	config := maillist.Config{
+		DatabaseAddress: os.Getenv("MAILLIST_DATABASE"),
+		UnsubscribeURL:  "https://myeventarc.localhost/unsubscribe",
+		Mailer:          mailer,
+	}
+
+	if s, err = maillist.OpenSession(&config); err != nil {
+		t.Fatalf("Could not open session: %v", err)
+	}
+	defer s.Close()
+	defer close(mailer.release)
+
+	a := maillist.Account{
+		ApplicationID: 0xdead000f,
+		FirstName:     "Test",
+		LastName:      "InsertCampaignWhileSending",
+		Email:         "testinsertcampaignwhilesending@example.com",
+	}
+	if err = s.InsertAccount(&a); err != nil {
+		t.Fatalf("Could not insert account: %v\n", err)
+	}
+	defer s.DeleteAccount(a.ID)
+
+	l := maillist.List{
+		AccountID: a.ID,
+		Name:      "TestInsertCampaignWhileSending",
+	}
+	if err = s.InsertList(&l); err != nil {
+		t.Fatalf("Could not insert list: %v\n", err)
+	}
+	defer s.DeleteList(l.ID)
+
+	sub := maillist.Subscriber{
+		AccountID: a.ID,
+		FirstName: "Busy",
+		LastName:  "Sender",
+		Email:     "busy.sender@example.com",
+	}
+	if err = s.InsertSubscriber(&sub); err != nil {
+		t.Fatalf("Could not insert subscriber: %v\n", err)
+	}
+	defer s.DeleteSubscriber(sub.ID)
+
+	if err = s.AddSubscriberToList(l.ID, sub.ID); err != nil {
+		t.Fatalf("Could not add subscriber to list: %v\n", err)
+	}
+
+	c := maillist.Campaign{
+		AccountID: a.ID,
+		Subject:   "TestInsertCampaignWhileSending",
+		Body:      "Hi {{.FirstName}}",
+		Address:   "123 fake st",
+		Scheduled: time.Now().Unix(),
+	}
+	if err = s.InsertCampaign(&c, []int64{l.ID}, nil); err != nil {
+		t.Fatalf("Could not insert campaign: %v\n", err)
+	}
+
+	select {
+	case <-mailer.started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for send")
+	}
+
+	// the sender is now blocked, which mustn't block the API
+	start := time.Now()
+	c2 := c
+	c2.ID = 0
+	c2.ListIDs = ""
+	c2.EventIDs = ""
+	c2.Status = ""
+	if err = s.InsertCampaign(&c2, []int64{l.ID}, nil); err != nil {
+		t.Fatalf("Could not insert campaign: %v\n", err)
+	}
+	if err = s.CancelCampaign(c2.ID); err != nil {
+		t.Fatalf("Could not cancel campaign: %v\n", err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("inserting a campaign took %v while sending", d)
+	}
+}
+
+func TestPauseCampaign(t *testing.T) {
+	var (
+		err error
+		s   *maillist.Session
+	)
+
+	mailer := blockMailer{make(chan struct{}, 1), make(chan struct{})}
+	config := maillist.Config{
+		DatabaseAddress: os.Getenv("MAILLIST_DATABASE"),
+		UnsubscribeURL:  "https://myeventarc.localhost/unsubscribe",
+		Mailer:          mailer,
+	}
+
+	if s, err = maillist.OpenSession(&config); err != nil {
+		t.Fatalf("Could not open session: %v", err)
+	}
+	defer s.Close()
+
+	a := maillist.Account{
+		ApplicationID: 0xdead0010,
+		FirstName:     "Test",
+		LastName:      "PauseCampaign",
+		Email:         "testpausecampaign@example.com",
+	}
+	if err = s.InsertAccount(&a); err != nil {
+		t.Fatalf("Could not insert account: %v\n", err)
+	}
+	defer s.DeleteAccount(a.ID)
+
+	l := maillist.List{
+		AccountID: a.ID,
+		Name:      "TestPauseCampaign",
+	}
+	if err = s.InsertList(&l); err != nil {
+		t.Fatalf("Could not insert list: %v\n", err)
+	}
+	defer s.DeleteList(l.ID)
+
+	for _, name := range []string{"Paula", "Peter"} {
+		sub := maillist.Subscriber{
+			AccountID: a.ID,
+			FirstName: name,
+			LastName:  "Pause",
+			Email:     name + ".pause@example.com",
+		}
+		if err = s.InsertSubscriber(&sub); err != nil {
+			t.Fatalf("Could not insert subscriber: %v\n", err)
+		}
+		defer s.DeleteSubscriber(sub.ID)
+
+		if err = s.AddSubscriberToList(l.ID, sub.ID); err != nil {
+			t.Fatalf("Could not add subscriber to list: %v\n", err)
+		}
+	}
+
+	c := maillist.Campaign{
+		AccountID: a.ID,
+		Subject:   "TestPauseCampaign",
+		Body:      "Hi {{.FirstName}}",
+		Address:   "123 fake st",
+		Scheduled: time.Now().Unix(),
+	}
+	if err = s.InsertCampaign(&c, []int64{l.ID}, nil); err != nil {
+		t.Fatalf("Could not insert campaign: %v\n", err)
+	}
+
+	select {
+	case <-mailer.started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for send")
+	}
+
+	if err = s.PauseCampaign(c.ID); err != nil {
+		t.Fatalf("Could not pause campaign: %v\n", err)
+	}
+	close(mailer.release)
+
+	select {
+	case <-mailer.started:
+		t.Fatal("message sent while campaign was paused")
+	case <-time.After(2 * time.Second):
+	}
+
+	if c2, err := s.GetCampaign(c.ID); err != nil {
+		t.Fatalf("Could not get campaign: %v\n", err)
+	} else if c2.Status != "paused" {
+		t.Errorf("got campaign status '%s', want 'paused'", c2.Status)
+	}
+
+	if err = s.ResumeCampaign(c.ID); err != nil {
+		t.Fatalf("Could not resume campaign: %v\n", err)
+	}
+
+	select {
+	case <-mailer.started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for resumed campaign")
+	}
+	time.Sleep(time.Second)
+
+	if c2, err := s.GetCampaign(c.ID); err != nil {
+		t.Fatalf("Could not get campaign: %v\n", err)
+	} else if c2.Status != "sent" {
+		t.Errorf("got campaign status '%s', want 'sent'", c2.Status)
+	}
+
+	if err = s.ResumeCampaign(c.ID); err == nil {
+		t.Error("resumed a campaign which isn't paused")
+	}
+}
+
+func TestRecurringCampaign(t *testing.T) {
+	var (
+		err error
+		s   *maillist.Session
+	)
+
+	mailer := make(chanMailer, 1)
+	config := maillist.Config{
+		DatabaseAddress: os.Getenv("MAILLIST_DATABASE"),
+		UnsubscribeURL:  "https://myeventarc.localhost/unsubscribe",
+		Mailer:          mailer,
+	}
+
+	if s, err = maillist.OpenSession(&config); err != nil {
+		t.Fatalf("Could not open session: %v", err)
+	}
+	defer s.Close()
+
+	a := maillist.Account{
+		ApplicationID: 0xdead0011,
+		FirstName:     "Test",
+		LastName:      "RecurringCampaign",
+		Email:         "testrecurringcampaign@example.com",
+	}
+	if err = s.InsertAccount(&a); err != nil {
+		t.Fatalf("Could not insert account: %v\n", err)
+	}
+	defer s.DeleteAccount(a.ID)
+
+	l := maillist.List{
+		AccountID: a.ID,
+		Name:      "TestRecurringCampaign",
+	}
+	if err = s.InsertList(&l); err != nil {
+		t.Fatalf("Could not insert list: %v\n", err)
+	}
+	defer s.DeleteList(l.ID)
+
+	sub := maillist.Subscriber{
+		AccountID: a.ID,
+		FirstName: "Rita",
+		LastName:  "Recurring",
+		Email:     "rita.recurring@example.com",
+	}
+	if err = s.InsertSubscriber(&sub); err != nil {
+		t.Fatalf("Could not insert subscriber: %v\n", err)
+	}
+	defer s.DeleteSubscriber(sub.ID)
+
+	if err = s.AddSubscriberToList(l.ID, sub.ID); err != nil {
+		t.Fatalf("Could not add subscriber to list: %v\n", err)
+	}
+
+	c := maillist.Campaign{
+		AccountID:       a.ID,
+		Subject:         "TestRecurringCampaign",
+		Body:            "Hi {{.FirstName}}",
+		Address:         "123 fake st",
+		Scheduled:       time.Now().Truncate(time.Minute).Unix(),
+		Recurrence:      "* * * * *",
+		RecurrenceLimit: 1,
+	}
+	if err = s.InsertCampaign(&c, []int64{l.ID}, nil); err != nil {
+		t.Fatalf("Could not insert campaign: %v\n", err)
+	}
+	if c.Status != "recurring" {
+		t.Errorf("got campaign status '%s', want 'recurring'", c.Status)
+	}
+
+	select {
+	case e := <-mailer:
+		if e.To.Address != sub.Email {
+			t.Errorf("unexpected email: %+v", e)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for email")
+	}
+
+	cs, err := s.GetCampaignOccurrences(c.ID)
+	if err != nil {
+		t.Fatalf("Could not get occurrences: %v\n", err)
+	}
+	if len(cs) != 1 || cs[0].ParentID != c.ID || cs[0].Scheduled != c.Scheduled {
+		t.Errorf("got occurrences %+v, want one scheduled at %d", cs, c.Scheduled)
+	}
+
+	// the occurrence limit has been reached
+	if c2, err := s.GetCampaign(c.ID); err != nil {
+		t.Fatalf("Could not get campaign: %v\n", err)
+	} else if c2.Status != "sent" || c2.Occurrences != 1 {
+		t.Errorf("got status '%s' after %d occurrences, want 'sent' after 1", c2.Status, c2.Occurrences)
+	}
+}
+
+func TestLocalTime(t *testing.T) {
+	var (
+		err error
+		s   *maillist.Session
+	)
+
+	mailer := make(chanMailer, 2)
+	config := maillist.Config{
+		DatabaseAddress: os.Getenv("MAILLIST_DATABASE"),
+		UnsubscribeURL:  "https://myeventarc.localhost/unsubscribe",
+		Mailer:          mailer,
+	}
+
+	if s, err = maillist.OpenSession(&config); err != nil {
+		t.Fatalf("Could not open session: %v", err)
+	}
+	defer s.Close()
+
+	a := maillist.Account{
+		ApplicationID: 0xdead0012,
+		FirstName:     "Test",
+		LastName:      "LocalTime",
+		Email:         "testlocaltime@example.com",
+		Timezone:      "UTC",
+	}
+	if err = s.InsertAccount(&a); err != nil {
+		t.Fatalf("Could not insert account: %v\n", err)
+	}
+	defer s.DeleteAccount(a.ID)
+
+	l := maillist.List{
+		AccountID: a.ID,
+		Name:      "TestLocalTime",
+	}
+	if err = s.InsertList(&l); err != nil {
+		t.Fatalf("Could not insert list: %v\n", err)
+	}
+	defer s.DeleteList(l.ID)
+
+	// Kiribati is 14 hours ahead of UTC, where the other subscriber is
+	for _, sub := range []maillist.Subscriber{
+		{FirstName: "Kiri", Email: "kiri.localtime@example.com", Timezone: "Pacific/Kiritimati"},
+		{FirstName: "Uta", Email: "uta.localtime@example.com"},
+	} {
+		sub.AccountID = a.ID
+		sub.LastName = "LocalTime"
+		if err = s.InsertSubscriber(&sub); err != nil {
+			t.Fatalf("Could not insert subscriber: %v\n", err)
+		}
+		defer s.DeleteSubscriber(sub.ID)
+
+		if err = s.AddSubscriberToList(l.ID, sub.ID); err != nil {
+			t.Fatalf("Could not add subscriber to list: %v\n", err)
+		}
+	}
+
+	bad := maillist.Subscriber{
+		AccountID: a.ID,
+		FirstName: "Nowhere",
+		LastName:  "LocalTime",
+		Email:     "nowhere.localtime@example.com",
+		Timezone:  "Nowhere/Special",
+	}
+	if err = s.InsertSubscriber(&bad); err == nil {
+		s.DeleteSubscriber(bad.ID)
+		t.Error("inserted a subscriber with an unknown timezone")
+	}
+
+	c := maillist.Campaign{
+		AccountID: a.ID,
+		Subject:   "TestLocalTime",
+		Body:      "Hi {{.FirstName}}",
+		Address:   "123 fake st",
+		Scheduled: time.Now().Add(14 * time.Hour).Unix(),
+		LocalTime: true,
+	}
+	if err = s.InsertCampaign(&c, []int64{l.ID}, nil); err != nil {
+		t.Fatalf("Could not insert campaign: %v\n", err)
+	}
+
+	select {
+	case e := <-mailer:
+		if e.To.Address != "kiri.localtime@example.com" {
+			t.Errorf("got email to %s, want it to be sent to Kiribati first", e.To.Address)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for email")
+	}
+
+	select {
+	case e := <-mailer:
+		t.Errorf("got email to %s, before the scheduled time in UTC", e.To.Address)
+	case <-time.After(2 * time.Second):
+	}
+	s.CancelCampaign(c.ID)
+}
+
+func TestSendingWindow(t *testing.T) {
+	var (
+		err error
+		s   *maillist.Session
+	)
+
+	mailer := make(chanMailer, 1)
+	config := maillist.Config{
+		DatabaseAddress: os.Getenv("MAILLIST_DATABASE"),
+		UnsubscribeURL:  "https://myeventarc.localhost/unsubscribe",
+		Mailer:          mailer,
+	}
+
+	if s, err = maillist.OpenSession(&config); err != nil {
+		t.Fatalf("Could not open session: %v", err)
+	}
+	defer s.Close()
+
+	// only open tomorrow
+	tomorrow := time.Now().UTC().AddDate(0, 0, 1).Weekday().String()[:3]
+	a := maillist.Account{
+		ApplicationID: 0xdead0013,
+		FirstName:     "Test",
+		LastName:      "SendingWindow",
+		Email:         "testsendingwindow@example.com",
+		Timezone:      "UTC",
+		SendingWindow: tomorrow + " 00:00-24:00",
+	}
+	if err = s.InsertAccount(&a); err != nil {
+		t.Fatalf("Could not insert account: %v\n", err)
+	}
+	defer s.DeleteAccount(a.ID)
+
+	l := maillist.List{
+		AccountID: a.ID,
+		Name:      "TestSendingWindow",
+	}
+	if err = s.InsertList(&l); err != nil {
+		t.Fatalf("Could not insert list: %v\n", err)
+	}
+	defer s.DeleteList(l.ID)
+
+	sub := maillist.Subscriber{
+		AccountID: a.ID,
+		FirstName: "Wendy",
+		LastName:  "Window",
+		Email:     "wendy.window@example.com",
+	}
+	if err = s.InsertSubscriber(&sub); err != nil {
+		t.Fatalf("Could not insert subscriber: %v\n", err)
+	}
+	defer s.DeleteSubscriber(sub.ID)
+
+	if err = s.AddSubscriberToList(l.ID, sub.ID); err != nil {
+		t.Fatalf("Could not add subscriber to list: %v\n", err)
+	}
+
+	c := maillist.Campaign{
+		AccountID: a.ID,
+		Subject:   "TestSendingWindow",
+		Body:      "Hi {{.FirstName}}",
+		Address:   "123 fake st",
+		Scheduled: time.Now().Unix(),
+	}
+	if err = s.InsertCampaign(&c, []int64{l.ID}, nil); err != nil {
+		t.Fatalf("Could not insert campaign: %v\n", err)
+	}
+	defer s.CancelCampaign(c.ID)
+
+	select {
+	case e := <-mailer:
+		t.Errorf("got email to %s outside the sending window", e.To.Address)
+	case <-time.After(3 * time.Second):
+	}
+
+	if c2, err := s.GetCampaign(c.ID); err != nil {
+		t.Fatalf("Could not get campaign: %v\n", err)
+	} else if c2.Status != "pending" {
+		t.Errorf("got campaign status '%s', want 'pending'", c2.Status)
+	}
+
+	for _, window := range []string{"mon-fri", "mon 09:00", "mon 20:00-08:00", "someday 09:00-17:00", "mon 09:00-25:00"} {
+		a.SendingWindow = window
+		if err = s.UpdateAccount(&a); err == nil {
+			t.Errorf("accepted invalid sending window '%s'", window)
+		}
+	}
+}
+
+func TestDomainLimits(t *testing.T) {
+	var (
+		err error
+		s   *maillist.Session
+	)
+
+	mailer := make(chanMailer, 3)
+	config := maillist.Config{
+		DatabaseAddress: os.Getenv("MAILLIST_DATABASE"),
+		UnsubscribeURL:  "https://myeventarc.localhost/unsubscribe",
+		Mailer:          mailer,
+		DomainLimits:    map[string]int{"slow.example.com": 1},
+	}
+
+	if s, err = maillist.OpenSession(&config); err != nil {
+		t.Fatalf("Could not open session: %v", err)
+	}
+	defer s.Close()
+
+	a := maillist.Account{
+		ApplicationID: 0xdead0014,
+		FirstName:     "Test",
+		LastName:      "DomainLimits",
+		Email:         "testdomainlimits@example.com",
+	}
+	if err = s.InsertAccount(&a); err != nil {
+		t.Fatalf("Could not insert account: %v\n", err)
+	}
+	defer s.DeleteAccount(a.ID)
+
+	l := maillist.List{
+		AccountID: a.ID,
+		Name:      "TestDomainLimits",
+	}
+	if err = s.InsertList(&l); err != nil {
+		t.Fatalf("Could not insert list: %v\n", err)
+	}
+	defer s.DeleteList(l.ID)
+
+	for _, email := range []string{"one@slow.example.com", "two@SLOW.example.com", "three@fast.example.com"} {
+		sub := maillist.Subscriber{
+			AccountID: a.ID,
+			FirstName: "Dom",
+			LastName:  "Limits",
+			Email:     email,
+		}
+		if err = s.InsertSubscriber(&sub); err != nil {
+			t.Fatalf("Could not insert subscriber: %v\n", err)
+		}
+		defer s.DeleteSubscriber(sub.ID)
+
+		if err = s.AddSubscriberToList(l.ID, sub.ID); err != nil {
+			t.Fatalf("Could not add subscriber to list: %v\n", err)
+		}
+	}
+
+	c := maillist.Campaign{
+		AccountID: a.ID,
+		Subject:   "TestDomainLimits",
+		Body:      "Hi {{.FirstName}}",
+		Address:   "123 fake st",
+		Scheduled: time.Now().Unix(),
+	}
+	if err = s.InsertCampaign(&c, []int64{l.ID}, nil); err != nil {
+		t.Fatalf("Could not insert campaign: %v\n", err)
+	}
+	defer s.CancelCampaign(c.ID)
+
+	domains := make(map[string]int)
+	timeout := time.After(3 * time.Second)
+	for done := false; !done; {
+		select {
+		case e := <-mailer:
+			domains[strings.ToLower(e.To.Address[strings.Index(e.To.Address, "@")+1:])]++
+		case <-timeout:
+			done = true
+		}
+	}
+
+	if domains["slow.example.com"] != 1 || domains["fast.example.com"] != 1 {
+		t.Errorf("got %v, want one e-mail to each domain within the limit", domains)
+	}
+}
+
+func TestWarmup(t *testing.T) {
+	var (
+		err error
+		s   *maillist.Session
+	)
+
+	mailer := make(chanMailer, 3)
+	config := maillist.Config{
+		DatabaseAddress: os.Getenv("MAILLIST_DATABASE"),
+		UnsubscribeURL:  "https://myeventarc.localhost/unsubscribe",
+		Mailer:          mailer,
+	}
+
+	if s, err = maillist.OpenSession(&config); err != nil {
+		t.Fatalf("Could not open session: %v", err)
+	}
+	defer s.Close()
+
+	a := maillist.Account{
+		ApplicationID: 0xdead0015,
+		FirstName:     "Test",
+		LastName:      "Warmup",
+		Email:         "testwarmup@example.com",
+		Warmup:        "1,2",
+	}
+	if err = s.InsertAccount(&a); err != nil {
+		t.Fatalf("Could not insert account: %v\n", err)
+	}
+	defer s.DeleteAccount(a.ID)
+
+	if a.WarmupStart == 0 {
+		t.Errorf("WarmupStart wasn't set")
+	}
+
+	bad := a
+	bad.Warmup = "50,lots"
+	if err = s.UpdateAccount(&bad); err == nil {
+		t.Errorf("Expected an error updating an account with an invalid warm-up")
+	}
+
+	l := maillist.List{
+		AccountID: a.ID,
+		Name:      "TestWarmup",
+	}
+	if err = s.InsertList(&l); err != nil {
+		t.Fatalf("Could not insert list: %v\n", err)
+	}
+	defer s.DeleteList(l.ID)
+
+	for _, name := range []string{"one", "two", "three", "four"} {
+		sub := maillist.Subscriber{
+			AccountID: a.ID,
+			FirstName: name,
+			LastName:  "Warmup",
+			Email:     name + "@warmup.example.com",
+		}
+		if err = s.InsertSubscriber(&sub); err != nil {
+			t.Fatalf("Could not insert subscriber: %v\n", err)
+		}
+		defer s.DeleteSubscriber(sub.ID)
+
+		if err = s.AddSubscriberToList(l.ID, sub.ID); err != nil {
+			t.Fatalf("Could not add subscriber to list: %v\n", err)
+		}
+	}
+
+	c := maillist.Campaign{
+		AccountID: a.ID,
+		Subject:   "TestWarmup",
+		Body:      "Hi {{.FirstName}}",
+		Address:   "123 fake st",
+		Status:    "draft",
+		Scheduled: time.Now().Unix(),
+	}
+	if err = s.InsertCampaign(&c, []int64{l.ID}, nil); err != nil {
+		t.Fatalf("Could not insert campaign: %v\n", err)
+	}
+	defer s.CancelCampaign(c.ID)
+
+	// one today, two tomorrow and the last once the ramp is over
+	if days, err := s.WarmupDaysRemaining(c.ID); err != nil || days != 3 {
+		t.Errorf("WarmupDaysRemaining before sending = %d, %v; want 3", days, err)
+	}
+
+	c.Status = "scheduled"
+	if err = s.UpdateCampaign(&c); err != nil {
+		t.Fatalf("Could not schedule campaign: %v\n", err)
+	}
+
+	var sent int
+	timeout := time.After(3 * time.Second)
+	for done := false; !done; {
+		select {
+		case <-mailer:
+			sent++
+		case <-timeout:
+			done = true
+		}
+	}
+	if sent != 1 {
+		t.Errorf("sent %d e-mails on the first day of warm-up, want 1", sent)
+	}
+
+	if days, err := s.WarmupDaysRemaining(c.ID); err != nil || days != 3 {
+		t.Errorf("WarmupDaysRemaining after sending = %d, %v; want 3", days, err)
+	}
+}
+
+func TestFairScheduling(t *testing.T) {
+	var (
+		err error
+		s   *maillist.Session
+	)
+
+	mailer := make(chanMailer, 6)
+	config := maillist.Config{
+		DatabaseAddress: os.Getenv("MAILLIST_DATABASE"),
+		UnsubscribeURL:  "https://myeventarc.localhost/unsubscribe",
+		Mailer:          mailer,
+	}
+
+	if s, err = maillist.OpenSession(&config); err != nil {
+		t.Fatalf("Could not open session: %v", err)
+	}
+	defer s.Close()
+
+	// both campaigns are expanded together, after which the small one
+	// should be sent without waiting for the large one to finish
+	scheduled := time.Now().Add(2 * time.Second).Unix()
+	sizes := []int{5, 1}
+	for i, size := range sizes {
+		a := maillist.Account{
+			ApplicationID: 0xdead0016 + int64(i),
+			FirstName:     "Test",
+			LastName:      "FairScheduling",
+			Email:         fmt.Sprintf("testfair%d@example.com", i),
+		}
+		if err = s.InsertAccount(&a); err != nil {
+			t.Fatalf("Could not insert account: %v\n", err)
+		}
+		defer s.DeleteAccount(a.ID)
+
+		if a.Priority != 1 {
+			t.Errorf("account priority = %d, want 1 by default", a.Priority)
+		}
+
+		l := maillist.List{
+			AccountID: a.ID,
+			Name:      "TestFairScheduling",
+		}
+		if err = s.InsertList(&l); err != nil {
+			t.Fatalf("Could not insert list: %v\n", err)
+		}
+		defer s.DeleteList(l.ID)
+
+		for j := 0; j < size; j++ {
+			sub := maillist.Subscriber{
+				AccountID: a.ID,
+				FirstName: "Fair",
+				LastName:  "Scheduling",
+				Email:     fmt.Sprintf("fair%d-%d@example.com", i, j),
+			}
+			if err = s.InsertSubscriber(&sub); err != nil {
+				t.Fatalf("Could not insert subscriber: %v\n", err)
+			}
+			defer s.DeleteSubscriber(sub.ID)
+
+			if err = s.AddSubscriberToList(l.ID, sub.ID); err != nil {
+				t.Fatalf("Could not add subscriber to list: %v\n", err)
+			}
+		}
+
+		c := maillist.Campaign{
+			AccountID: a.ID,
+			Subject:   "TestFairScheduling",
+			Body:      "Hi {{.FirstName}}",
+			Address:   "123 fake st",
+			Scheduled: scheduled,
+		}
+		if err = s.InsertCampaign(&c, []int64{l.ID}, nil); err != nil {
+			t.Fatalf("Could not insert campaign: %v\n", err)
+		}
+		defer s.CancelCampaign(c.ID)
+	}
+
+	for i := 0; i < 2; i++ {
+		select {
+		case e := <-mailer:
+			if strings.HasPrefix(e.To.Address, "fair1-") {
+				return
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timed out waiting for e-mails")
+		}
+	}
+	t.Errorf("small campaign wasn't among the first two e-mails sent")
+}
+
+func TestSendTransactional(t *testing.T) {
+	var (
+		err error
+		s   *maillist.Session
+	)
+
+	mailer := make(chanMailer, 1)
+	config := maillist.Config{
+		DatabaseAddress: os.Getenv("MAILLIST_DATABASE"),
+		UnsubscribeURL:  "https://myeventarc.localhost/unsubscribe",
+		Mailer:          mailer,
+	}
+
+	if s, err = maillist.OpenSession(&config); err != nil {
+		t.Fatalf("Could not open session: %v", err)
+	}
+	defer s.Close()
+
+	a := maillist.Account{
+		ApplicationID: 0xdead0018,
+		FirstName:     "Test",
+		LastName:      "SendTransactional",
+		Email:         "testsendtransactional@example.com",
+	}
+	if err = s.InsertAccount(&a); err != nil {
+		t.Fatalf("Could not insert account: %v\n", err)
+	}
+	defer s.DeleteAccount(a.ID)
+
+	id, err := s.SendTransactional(&maillist.Transactional{
+		AccountID: a.ID,
+		Subject:   "Reset your password",
+		Body:      "Hi {{.FirstName}}, click here to reset your password",
+		Address:   "123 fake st",
+		Email:     "transactional@example.com",
+		FirstName: "Trans",
+		LastName:  "Actional",
+	})
+	if err != nil {
+		t.Fatalf("Could not send transactional e-mail: %v\n", err)
+	}
+
+	select {
+	case e := <-mailer:
+		if e.To.Address != "transactional@example.com" || e.Body != "Hi Trans, click here to reset your password" {
+			t.Errorf("got e-mail to %s: %q", e.To.Address, e.Body)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timed out waiting for transactional e-mail")
+	}
+
+	var m *maillist.Message
+	for i := 0; i < 50; i++ {
+		if m, err = s.GetTransactional(id); err != nil {
+			t.Fatalf("Could not get transactional e-mail: %v\n", err)
+		}
+		if m.Status == "sent" {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if m.Status != "sent" {
+		t.Errorf("transactional e-mail status = %s, want sent", m.Status)
+	}
+
+	if _, err = s.GetCampaignsInAccount(a.ID); err != maillist.ErrNotFound {
+		t.Errorf("transactional e-mail was listed as a campaign: %v", err)
+	}
+	if sub, err := s.GetSubscriberByEmail("transactional@example.com", a.ID); err == nil {
+		s.DeleteSubscriber(sub.ID)
+	}
+}
+
+func TestHTMLCampaign(t *testing.T) {
+	var (
+		err error
+		s   *maillist.Session
+	)
+
+	mailer := make(chanMailer, 1)
+	config := maillist.Config{
+		DatabaseAddress: os.Getenv("MAILLIST_DATABASE"),
+		UnsubscribeURL:  "https://myeventarc.localhost/unsubscribe",
+		Mailer:          mailer,
+	}
+
+	if s, err = maillist.OpenSession(&config); err != nil {
+		t.Fatalf("Could not open session: %v", err)
+	}
+	defer s.Close()
+
+	a := maillist.Account{
+		ApplicationID: 0xdead0019,
+		FirstName:     "Test",
+		LastName:      "HTMLCampaign",
+		Email:         "testhtmlcampaign@example.com",
+	}
+	if err = s.InsertAccount(&a); err != nil {
+		t.Fatalf("Could not insert account: %v\n", err)
+	}
+	defer s.DeleteAccount(a.ID)
+
+	l := maillist.List{
+		AccountID: a.ID,
+		Name:      "TestHTMLCampaign",
+	}
+	if err = s.InsertList(&l); err != nil {
+		t.Fatalf("Could not insert list: %v\n", err)
+	}
+	defer s.DeleteList(l.ID)
+
+	sub := maillist.Subscriber{
+		AccountID: a.ID,
+		FirstName: "Mary",
+		LastName:  "Markup",
+		Email:     "mary.markup@example.com",
+	}
+	if err = s.InsertSubscriber(&sub); err != nil {
+		t.Fatalf("Could not insert subscriber: %v\n", err)
+	}
+	defer s.DeleteSubscriber(sub.ID)
+
+	if err = s.AddSubscriberToList(l.ID, sub.ID); err != nil {
+		t.Fatalf("Could not add subscriber to list: %v\n", err)
+	}
+
+	c := maillist.Campaign{
+		AccountID: a.ID,
+		Subject:   "TestHTMLCampaign",
+		Address:   "123 fake st",
+		Scheduled: time.Now().Unix(),
+	}
+	if err = s.InsertCampaign(&c, []int64{l.ID}, nil); err == nil {
+		t.Fatalf("Expected an error inserting a campaign without a body")
+	}
+
+	c.HTMLBody = `<!DOCTYPE html><html><body><p>Hi <b>{{.FirstName}}</b>,</p><p><a href="https://example.com">Tickets</a></p></body></html>`
+	if err = s.InsertCampaign(&c, []int64{l.ID}, nil); err != nil {
+		t.Fatalf("Could not insert campaign: %v\n", err)
+	}
+	defer s.CancelCampaign(c.ID)
+
+	select {
+	case e := <-mailer:
+		if !strings.Contains(e.HTML, "<b>Mary</b>") {
+			t.Errorf("got HTML part %q", e.HTML)
+		}
+		if want := "Hi Mary,\n\nTickets (https://example.com)"; e.Body != want {
+			t.Errorf("got text part %q, want %q", e.Body, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timed out waiting for e-mail")
+	}
+}
+
+func TestTextTemplate(t *testing.T) {
+	var (
+		err error
+		s   *maillist.Session
+	)
+
+	mailer := make(chanMailer, 1)
+	config := maillist.Config{
+		DatabaseAddress: os.Getenv("MAILLIST_DATABASE"),
+		UnsubscribeURL:  "https://myeventarc.localhost/unsubscribe",
+		Mailer:          mailer,
+	}
+
+	if s, err = maillist.OpenSession(&config); err != nil {
+		t.Fatalf("Could not open session: %v", err)
+	}
+	defer s.Close()
+
+	a := maillist.Account{
+		ApplicationID: 0xdead001a,
+		FirstName:     "Test",
+		LastName:      "TextTemplate",
+		Email:         "testtexttemplate@example.com",
+	}
+	if err = s.InsertAccount(&a); err != nil {
+		t.Fatalf("Could not insert account: %v\n", err)
+	}
+	defer s.DeleteAccount(a.ID)
+
+	l := maillist.List{
+		AccountID: a.ID,
+		Name:      "TestTextTemplate",
+	}
+	if err = s.InsertList(&l); err != nil {
+		t.Fatalf("Could not insert list: %v\n", err)
+	}
+	defer s.DeleteList(l.ID)
+
+	sub := maillist.Subscriber{
+		AccountID: a.ID,
+		FirstName: "Pat & Sam",
+		LastName:  "O'Brien",
+		Email:     "obrien@example.com",
+	}
+	if err = s.InsertSubscriber(&sub); err != nil {
+		t.Fatalf("Could not insert subscriber: %v\n", err)
+	}
+	defer s.DeleteSubscriber(sub.ID)
+
+	if err = s.AddSubscriberToList(l.ID, sub.ID); err != nil {
+		t.Fatalf("Could not add subscriber to list: %v\n", err)
+	}
+
+	c := maillist.Campaign{
+		AccountID: a.ID,
+		Subject:   "TestTextTemplate",
+		Body:      "Hi {{.FirstName}} {{.LastName | upper}}",
+		HTMLBody:  "<p>Hi {{.FirstName}} {{.LastName | upper}}</p>",
+		Address:   "123 fake st",
+		Scheduled: time.Now().Unix(),
+	}
+	if err = s.InsertCampaign(&c, []int64{l.ID}, nil); err != nil {
+		t.Fatalf("Could not insert campaign: %v\n", err)
+	}
+	defer s.CancelCampaign(c.ID)
+
+	select {
+	case e := <-mailer:
+		if want := "Hi Pat & Sam O'BRIEN"; e.Body != want {
+			t.Errorf("got text part %q, want %q", e.Body, want)
+		}
+		if want := "<p>Hi Pat &amp; Sam O&#39;BRIEN</p>"; e.HTML != want {
+			t.Errorf("got HTML part %q, want %q", e.HTML, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timed out waiting for e-mail")
+	}
+}
+
+func TestSubjectTemplate(t *testing.T) {
+	var (
+		err error
+		s   *maillist.Session
+	)
+
+	mailer := make(chanMailer, 1)
+	config := maillist.Config{
+		DatabaseAddress: os.Getenv("MAILLIST_DATABASE"),
+		UnsubscribeURL:  "https://myeventarc.localhost/unsubscribe",
+		Mailer:          mailer,
+	}
+
+	if s, err = maillist.OpenSession(&config); err != nil {
+		t.Fatalf("Could not open session: %v", err)
+	}
+	defer s.Close()
+
+	a := maillist.Account{
+		ApplicationID: 0xdead001b,
+		FirstName:     "Test",
+		LastName:      "SubjectTemplate",
+		Email:         "testsubjecttemplate@example.com",
+	}
+	if err = s.InsertAccount(&a); err != nil {
+		t.Fatalf("Could not insert account: %v\n", err)
+	}
+	defer s.DeleteAccount(a.ID)
+
+	l := maillist.List{
+		AccountID: a.ID,
+		Name:      "TestSubjectTemplate",
+	}
+	if err = s.InsertList(&l); err != nil {
+		t.Fatalf("Could not insert list: %v\n", err)
+	}
+	defer s.DeleteList(l.ID)
+
+	sub := maillist.Subscriber{
+		AccountID: a.ID,
+		FirstName: "Sue",
+		LastName:  "O'Brien",
+		Email:     "sue.obrien@example.com",
+	}
+	if err = s.InsertSubscriber(&sub); err != nil {
+		t.Fatalf("Could not insert subscriber: %v\n", err)
+	}
+	defer s.DeleteSubscriber(sub.ID)
+
+	if err = s.AddSubscriberToList(l.ID, sub.ID); err != nil {
+		t.Fatalf("Could not add subscriber to list: %v\n", err)
+	}
+
+	c := maillist.Campaign{
+		AccountID: a.ID,
+		Subject:   "{{.FirstName}, your tickets",
+		Body:      "Hi {{.FirstName}}",
+		Address:   "123 fake st",
+		Scheduled: time.Now().Unix(),
+	}
+	if err = s.InsertCampaign(&c, []int64{l.ID}, nil); err == nil {
+		t.Fatalf("Expected an error inserting a campaign with an invalid subject")
+	}
+
+	c.Subject = "{{.FirstName}}, your tickets"
+	c.Preheader = "Doors open at 7, {{.LastName}}"
+	if err = s.InsertCampaign(&c, []int64{l.ID}, nil); err != nil {
+		t.Fatalf("Could not insert campaign: %v\n", err)
+	}
+	defer s.CancelCampaign(c.ID)
+
+	select {
+	case e := <-mailer:
+		if want := "Sue, your tickets"; e.Subject != want {
+			t.Errorf("got subject %q, want %q", e.Subject, want)
+		}
+		if !strings.Contains(e.HTML, ">Doors open at 7, O&#39;Brien</div>") {
+			t.Errorf("preheader missing from HTML part %q", e.HTML)
+		}
+		if strings.Contains(e.Body, "Doors open") {
+			t.Errorf("preheader shouldn't be in the text part %q", e.Body)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timed out waiting for e-mail")
+	}
+}
+
+func TestTemplateValidation(t *testing.T) {
+	var (
+		err error
+		s   *maillist.Session
+	)
+
+	config := maillist.Config{
+		DatabaseAddress: os.Getenv("MAILLIST_DATABASE"),
+		UnsubscribeURL:  "https://myeventarc.localhost/unsubscribe",
+		JustPrint:       true,
+	}
+
+	if s, err = maillist.OpenSession(&config); err != nil {
+		t.Fatalf("Could not open session: %v", err)
+	}
+	defer s.Close()
+
+	a := maillist.Account{
+		ApplicationID: 0xdead001c,
+		FirstName:     "Test",
+		LastName:      "TemplateValidation",
+		Email:         "testtemplatevalidation@example.com",
+	}
+	if err = s.InsertAccount(&a); err != nil {
+		t.Fatalf("Could not insert account: %v\n", err)
+	}
+	defer s.DeleteAccount(a.ID)
+
+	l := maillist.List{
+		AccountID: a.ID,
+		Name:      "TestTemplateValidation",
+	}
+	if err = s.InsertList(&l); err != nil {
+		t.Fatalf("Could not insert list: %v\n", err)
+	}
+	defer s.DeleteList(l.ID)
+
+	for _, test := range []struct {
+		subject, body string
+		want          maillist.TemplateError
+	}{
+		{"Hi {{.FirstName}}", "Hi\n{{.Frist}} {{.Surname}}", maillist.TemplateError{
+			Field: "body", Line: 2, Column: 2, UnknownFields: []string{"Frist", "Surname"},
+		}},
+		{"Hi {{.FirstName", "Hi", maillist.TemplateError{Field: "subject", Line: 1}},
+		{"Hi", "{{.FirstName | nosuch}}", maillist.TemplateError{Field: "body", Line: 1}},
+		{"Hi {{index .FirstName 99}}", "Hi", maillist.TemplateError{Field: "subject", Line: 1, Column: 5}},
+	} {
+		c := maillist.Campaign{
+			AccountID: a.ID,
+			Subject:   test.subject,
+			Body:      test.body,
+			Address:   "123 fake st",
+			Scheduled: time.Now().Unix(),
+		}
+		err = s.InsertCampaign(&c, []int64{l.ID}, nil)
+		e, ok := err.(*maillist.TemplateError)
+		if !ok {
+			t.Errorf("InsertCampaign(%q, %q) = %v, want a TemplateError", test.subject, test.body, err)
+			continue
+		}
+		if e.Field != test.want.Field || e.Line != test.want.Line || e.Column != test.want.Column ||
+			strings.Join(e.UnknownFields, ",") != strings.Join(test.want.UnknownFields, ",") {
+			t.Errorf("InsertCampaign(%q, %q) = %+v, want %+v", test.subject, test.body, *e, test.want)
+		}
+	}
+
+	c := maillist.Campaign{
+		AccountID: a.ID,
+		Subject:   "Hi",
+		Body:      "Hi {{.FirstName}}",
+		Address:   "123 fake st",
+		Status:    "draft",
+		Scheduled: time.Now().Unix(),
+	}
+	if err = s.InsertCampaign(&c, []int64{l.ID}, nil); err != nil {
+		t.Fatalf("Could not insert campaign: %v\n", err)
+	}
+	defer s.CancelCampaign(c.ID)
+
+	c.HTMLBody = "<p>{{.Nmae}}</p>"
+	if _, ok := s.UpdateCampaign(&c).(*maillist.TemplateError); !ok {
+		t.Errorf("Expected a TemplateError updating a campaign with an unknown field")
+	}
+	c.HTMLBody = ""
+
+	// within with and range, fields are those of whatever dot is there
+	for _, body := range []string{
+		"{{with .Attr}}{{.company}}{{end}}",
+		"{{range $name, $value := .Attr}}{{$name}}: {{$value}}\n{{end}}",
+		"{{with .Attr.company}}{{.}}{{else}}{{.FirstName}}{{end}}",
+	} {
+		c.Body = body
+		if err = s.UpdateCampaign(&c); err != nil {
+			t.Errorf("UpdateCampaign(%q) = %v, want no error", body, err)
+		}
+	}
+
+	c.Body = "{{with .Attr}}{{$.Nmae}}{{end}}"
+	if e, ok := s.UpdateCampaign(&c).(*maillist.TemplateError); !ok || strings.Join(e.UnknownFields, ",") != "Nmae" {
+		t.Errorf("Expected a TemplateError for an unknown field of $ within with")
+	}
+}
+
+func TestSubscriberAttributes(t *testing.T) {
+	var (
+		err error
+		s   *maillist.Session
+	)
+
+	mailer := make(chanMailer, 2)
+	config := maillist.Config{
+		DatabaseAddress: os.Getenv("MAILLIST_DATABASE"),
+		UnsubscribeURL:  "https://myeventarc.localhost/unsubscribe",
+		Mailer:          mailer,
+	}
+
+	if s, err = maillist.OpenSession(&config); err != nil {
+		t.Fatalf("Could not open session: %v", err)
+	}
+	defer s.Close()
+
+	a := maillist.Account{
+		ApplicationID: 0xdead001d,
+		FirstName:     "Test",
+		LastName:      "SubscriberAttributes",
+		Email:         "testsubscriberattributes@example.com",
+	}
+	if err = s.InsertAccount(&a); err != nil {
+		t.Fatalf("Could not insert account: %v\n", err)
+	}
+	defer s.DeleteAccount(a.ID)
+
+	l := maillist.List{
+		AccountID: a.ID,
+		Name:      "TestSubscriberAttributes",
+	}
+	if err = s.InsertList(&l); err != nil {
+		t.Fatalf("Could not insert list: %v\n", err)
+	}
+	defer s.DeleteList(l.ID)
+
+	bad := maillist.Subscriber{
+		AccountID:  a.ID,
+		FirstName:  "Bad",
+		LastName:   "Attribute",
+		Email:      "bad.attribute@example.com",
+		Attributes: map[string]string{"ticket type": "VIP"},
+	}
+	if err = s.InsertSubscriber(&bad); err == nil {
+		s.DeleteSubscriber(bad.ID)
+		t.Errorf("Expected an error inserting a subscriber with an invalid attribute name")
+	}
+
+	subs := []*maillist.Subscriber{
+		{FirstName: "Ann", LastName: "Attr", Email: "ann.attr@example.com",
+			Attributes: map[string]string{"company": "Acme", "city": "Hobart"}},
+		{FirstName: "Bob", LastName: "Attr", Email: "bob.attr@example.com"},
+	}
+	for _, sub := range subs {
+		sub.AccountID = a.ID
+		if err = s.InsertSubscriber(sub); err != nil {
+			t.Fatalf("Could not insert subscriber: %v\n", err)
+		}
+		defer s.DeleteSubscriber(sub.ID)
+
+		if err = s.AddSubscriberToList(l.ID, sub.ID); err != nil {
+			t.Fatalf("Could not add subscriber to list: %v\n", err)
+		}
+	}
+
+	if err = s.SetSubscriberAttributes(subs[0].ID, map[string]string{"city": "", "ticket": "VIP"}); err != nil {
+		t.Fatalf("Could not set subscriber attributes: %v\n", err)
+	}
+	attrs, err := s.GetSubscriberAttributes(subs[0].ID)
+	if err != nil {
+		t.Fatalf("Could not get subscriber attributes: %v\n", err)
+	}
+	if len(attrs) != 2 || attrs["company"] != "Acme" || attrs["ticket"] != "VIP" {
+		t.Errorf("got attributes %v, want company and ticket", attrs)
+	}
+
+	c := maillist.Campaign{
+		AccountID: a.ID,
+		Subject:   "TestSubscriberAttributes",
+		Body:      `Hi {{.FirstName}} from {{.Attr.company | default "nowhere"}}`,
+		Address:   "123 fake st",
+		Scheduled: time.Now().Unix(),
+	}
+	if err = s.InsertCampaign(&c, []int64{l.ID}, nil); err != nil {
+		t.Fatalf("Could not insert campaign: %v\n", err)
+	}
+	defer s.CancelCampaign(c.ID)
+
+	want := map[string]string{
+		"ann.attr@example.com": "Hi Ann from Acme",
+		"bob.attr@example.com": "Hi Bob from nowhere",
+	}
+	for range subs {
+		select {
+		case e := <-mailer:
+			if e.Body != want[e.To.Address] {
+				t.Errorf("got %q for %s, want %q", e.Body, e.To.Address, want[e.To.Address])
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timed out waiting for e-mails")
+		}
+	}
+}
+
+func TestWorkers(t *testing.T) {
+	var (
+		err error
+		s   *maillist.Session
+	)
+
+	// each send blocks until all three have started, which only happens if
+	// they are sent concurrently
+	mailer := blockMailer{make(chan struct{}, 3), make(chan struct{})}
+	config := maillist.Config{
+		DatabaseAddress: os.Getenv("MAILLIST_DATABASE"),
+		UnsubscribeURL:  "https://myeventarc.localhost/unsubscribe",
+		Mailer:          mailer,
+		Workers:         3,
+	}
+
+	if s, err = maillist.OpenSession(&config); err != nil {
+		t.Fatalf("Could not open session: %v", err)
+	}
+	defer s.Close()
+
+	a := maillist.Account{
+		ApplicationID: 0xdead001e,
+		FirstName:     "Test",
+		LastName:      "Workers",
+		Email:         "testworkers@example.com",
+	}
+	if err = s.InsertAccount(&a); err != nil {
+		t.Fatalf("Could not insert account: %v\n", err)
+	}
+	defer s.DeleteAccount(a.ID)
+
+	l := maillist.List{
+		AccountID: a.ID,
+		Name:      "TestWorkers",
+	}
+	if err = s.InsertList(&l); err != nil {
+		t.Fatalf("Could not insert list: %v\n", err)
+	}
+	defer s.DeleteList(l.ID)
+
+	for i := 0; i < 3; i++ {
+		sub := maillist.Subscriber{
+			AccountID: a.ID,
+			FirstName: "Wendy",
+			LastName:  "Worker",
+			Email:     fmt.Sprintf("worker%d@example.com", i),
+		}
+		if err = s.InsertSubscriber(&sub); err != nil {
+			t.Fatalf("Could not insert subscriber: %v\n", err)
+		}
+		defer s.DeleteSubscriber(sub.ID)
+
+		if err = s.AddSubscriberToList(l.ID, sub.ID); err != nil {
+			t.Fatalf("Could not add subscriber to list: %v\n", err)
+		}
+	}
+	defer close(mailer.release)
+
+	c := maillist.Campaign{
+		AccountID: a.ID,
+		Subject:   "TestWorkers",
+		Body:      "Hi {{.FirstName}}",
+		Address:   "123 fake st",
+		Scheduled: time.Now().Unix(),
+	}
+	if err = s.InsertCampaign(&c, []int64{l.ID}, nil); err != nil {
+		t.Fatalf("Could not insert campaign: %v\n", err)
+	}
+
+	for i := 0; i < 3; i++ {
+		select {
+		case <-mailer.started:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("only %d of 3 e-mails were being sent concurrently", i)
+		}
+	}
+}
+
+func TestMaxPerSecond(t *testing.T) {
+	var (
+		err error
+		s   *maillist.Session
+	)
+
+	mailer := make(chanMailer, 6)
+	config := maillist.Config{
+		DatabaseAddress: os.Getenv("MAILLIST_DATABASE"),
+		UnsubscribeURL:  "https://myeventarc.localhost/unsubscribe",
+		Mailer:          mailer,
+		Workers:         3,
+		MaxPerSecond:    2,
+	}
+
+	if s, err = maillist.OpenSession(&config); err != nil {
+		t.Fatalf("Could not open session: %v", err)
+	}
+	defer s.Close()
+
+	a := maillist.Account{
+		ApplicationID: 0xdead001f,
+		FirstName:     "Test",
+		LastName:      "MaxPerSecond",
+		Email:         "testmaxpersecond@example.com",
+	}
+	if err = s.InsertAccount(&a); err != nil {
+		t.Fatalf("Could not insert account: %v\n", err)
+	}
+	defer s.DeleteAccount(a.ID)
+
+	l := maillist.List{
+		AccountID: a.ID,
+		Name:      "TestMaxPerSecond",
+	}
+	if err = s.InsertList(&l); err != nil {
+		t.Fatalf("Could not insert list: %v\n", err)
+	}
+	defer s.DeleteList(l.ID)
+
+	for i := 0; i < 6; i++ {
+		sub := maillist.Subscriber{
+			AccountID: a.ID,
+			FirstName: "Rita",
+			LastName:  "Rate",
+			Email:     fmt.Sprintf("rate%d@example.com", i),
+		}
+		if err = s.InsertSubscriber(&sub); err != nil {
+			t.Fatalf("Could not insert subscriber: %v\n", err)
+		}
+		defer s.DeleteSubscriber(sub.ID)
+
+		if err = s.AddSubscriberToList(l.ID, sub.ID); err != nil {
+			t.Fatalf("Could not add subscriber to list: %v\n", err)
+		}
+	}
+
+	c := maillist.Campaign{
+		AccountID: a.ID,
+		Subject:   "TestMaxPerSecond",
+		Body:      "Hi {{.FirstName}}",
+		Address:   "123 fake st",
+		Scheduled: time.Now().Unix(),
+	}
+	if err = s.InsertCampaign(&c, []int64{l.ID}, nil); err != nil {
+		t.Fatalf("Could not insert campaign: %v\n", err)
+	}
+
+	// a second's worth are sent straight away, and the other four at half
+	// second intervals
+	var first time.Time
+	for i := 0; i < 6; i++ {
+		select {
+		case <-mailer:
+			if i == 0 {
+				first = time.Now()
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timed out waiting for e-mails")
+		}
+	}
+	if d := time.Since(first); d < 1500*time.Millisecond {
+		t.Errorf("sent 6 e-mails in %v at 2 per second, want at least 1.5s", d)
+	}
+}
+
+// retryMailer records the time of each attempt to send, which always fails
+// with a transient error
+type retryMailer chan time.Time
+
+func (m retryMailer) Send(ctx context.Context, e *maillist.Email) error {
+	m <- time.Now()
+	return errors.New("mailbox temporarily unavailable")
+}
+
+// waitForTransactional polls a transactional e-mail until done reports true
+// of its message, or a few seconds have passed
+func waitForTransactional(t *testing.T, s *maillist.Session, id int64, done func(*maillist.Message) bool) *maillist.Message {
+	var m *maillist.Message
+	var err error
+	for i := 0; i < 50; i++ {
+		if m, err = s.GetTransactional(id); err != nil {
+			t.Fatalf("Could not get transactional e-mail: %v\n", err)
+		}
+		if done(m) {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return m
+}
+
+func TestRetryBackoff(t *testing.T) {
+	var (
+		err error
+		s   *maillist.Session
+		buf logger
+	)
+
+	mailer := make(retryMailer, 5)
+	config := maillist.Config{
+		DatabaseAddress: os.Getenv("MAILLIST_DATABASE"),
+		Logger:          &buf,
+		UnsubscribeURL:  "https://myeventarc.localhost/unsubscribe",
+		Mailer:          mailer,
+		MaxAttempts:     5,
+		RetryBackoff:    2 * time.Second,
+	}
+
+	if s, err = maillist.OpenSession(&config); err != nil {
+		t.Fatalf("Could not open session: %v", err)
+	}
+	defer s.Close()
+
+	a := maillist.Account{
+		ApplicationID: 0xdead0020,
+		FirstName:     "Test",
+		LastName:      "RetryBackoff",
+		Email:         "testretrybackoff@example.com",
+	}
+	if err = s.InsertAccount(&a); err != nil {
+		t.Fatalf("Could not insert account: %v\n", err)
+	}
+	defer s.DeleteAccount(a.ID)
+
+	id, err := s.SendTransactional(&maillist.Transactional{
+		AccountID: a.ID,
+		Subject:   "TestRetryBackoff",
+		Body:      "Hi {{.FirstName}}",
+		Address:   "123 fake st",
+		Email:     "retry.backoff@example.com",
+		FirstName: "Retry",
+		LastName:  "Backoff",
+	})
+	if err != nil {
+		t.Fatalf("Could not send transactional e-mail: %v\n", err)
+	}
+	defer func() {
+		if sub, err := s.GetSubscriberByEmail("retry.backoff@example.com", a.ID); err == nil {
+			s.DeleteSubscriber(sub.ID)
+		}
+	}()
+
+	// the delay doubles after each attempt: 2s, then 4s
+	for attempts := 1; attempts <= 2; attempts++ {
+		var sent time.Time
+		select {
+		case sent = <-mailer:
+		case <-time.After(8 * time.Second):
+			t.Fatalf("Timed out waiting for attempt %d", attempts)
+		}
+
+		m := waitForTransactional(t, s, id, func(m *maillist.Message) bool {
+			return m.Attempts == attempts
+		})
+		if m.Status != "pending" || m.Attempts != attempts {
+			t.Fatalf("after attempt %d got status %s with %d attempts, want pending", attempts, m.Status, m.Attempts)
+		}
+
+		backoff := config.RetryBackoff << uint(attempts-1)
+		want := sent.Add(backoff).Unix()
+		if m.NextAttempt < want-1 || m.NextAttempt > want+1 {
+			t.Errorf("after attempt %d next attempt is in %ds, want %v", attempts,
+				m.NextAttempt-sent.Unix(), backoff)
+		}
+	}
+}
+
+func TestMaxAttempts(t *testing.T) {
+	var (
+		err error
+		s   *maillist.Session
+		buf logger
+	)
+
+	mailer := make(retryMailer, 5)
+	config := maillist.Config{
+		DatabaseAddress: os.Getenv("MAILLIST_DATABASE"),
+		Logger:          &buf,
+		UnsubscribeURL:  "https://myeventarc.localhost/unsubscribe",
+		Mailer:          mailer,
+		MaxAttempts:     2,
+		RetryBackoff:    time.Second,
+	}
+
+	if s, err = maillist.OpenSession(&config); err != nil {
+		t.Fatalf("Could not open session: %v", err)
+	}
+	defer s.Close()
+
+	a := maillist.Account{
+		ApplicationID: 0xdead0021,
+		FirstName:     "Test",
+		LastName:      "MaxAttempts",
+		Email:         "testmaxattempts@example.com",
+	}
+	if err = s.InsertAccount(&a); err != nil {
+		t.Fatalf("Could not insert account: %v\n", err)
+	}
+	defer s.DeleteAccount(a.ID)
+
+	id, err := s.SendTransactional(&maillist.Transactional{
+		AccountID: a.ID,
+		Subject:   "TestMaxAttempts",
+		Body:      "Hi {{.FirstName}}",
+		Address:   "123 fake st",
+		Email:     "max.attempts@example.com",
+		FirstName: "Max",
+		LastName:  "Attempts",
+	})
+	if err != nil {
+		t.Fatalf("Could not send transactional e-mail: %v\n", err)
+	}
+	defer func() {
+		if sub, err := s.GetSubscriberByEmail("max.attempts@example.com", a.ID); err == nil {
+			s.DeleteSubscriber(sub.ID)
+		}
+	}()
+
+	for attempts := 1; attempts <= 2; attempts++ {
+		select {
+		case <-mailer:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timed out waiting for attempt %d", attempts)
+		}
+	}
+
+	m := waitForTransactional(t, s, id, func(m *maillist.Message) bool {
+		return m.Status == "failed"
+	})
+	if m.Status != "failed" || m.Attempts != 2 {
+		t.Errorf("got status %s with %d attempts, want failed after 2", m.Status, m.Attempts)
+	}
+	if m.LastError != "mailbox temporarily unavailable" {
+		t.Errorf("got last error %q", m.LastError)
+	}
+
+	select {
+	case <-mailer:
+		t.Errorf("message was attempted again after MaxAttempts")
+	case <-time.After(2 * time.Second):
+	}
+}
+
+// countMailer counts the e-mails sent to each address, taking a little time
+// over each so that sessions compete for messages
+type countMailer struct {
+	mu   sync.Mutex
+	sent map[string]int
+}
+
+func (m *countMailer) Send(ctx context.Context, e *maillist.Email) error {
+	time.Sleep(100 * time.Millisecond)
+	m.mu.Lock()
+	m.sent[e.To.Address]++
+	m.mu.Unlock()
+	return nil
+}
+
+func (m *countMailer) total() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n := 0
+	for _, count := range m.sent {
+		n += count
+	}
+	return n
+}
+
+func TestMultipleSessions(t *testing.T) {
+	var (
+		err error
+		s   [2]*maillist.Session
+	)
+
+	mailers := [2]*countMailer{{sent: map[string]int{}}, {sent: map[string]int{}}}
+	for i := range s {
+		config := maillist.Config{
+			DatabaseAddress: os.Getenv("MAILLIST_DATABASE"),
+			UnsubscribeURL:  "https://myeventarc.localhost/unsubscribe",
+			Mailer:          mailers[i],
+			Workers:         2,
+			PollInterval:    500 * time.Millisecond,
+		}
+		if s[i], err = maillist.OpenSession(&config); err != nil {
+			t.Fatalf("Could not open session: %v", err)
+		}
+		defer s[i].Close()
+	}
+
+	a := maillist.Account{
+		ApplicationID: 0xdead0022,
+		FirstName:     "Test",
+		LastName:      "MultipleSessions",
+		Email:         "testmultiplesessions@example.com",
+	}
+	if err = s[0].InsertAccount(&a); err != nil {
+		t.Fatalf("Could not insert account: %v\n", err)
+	}
+	defer s[0].DeleteAccount(a.ID)
+
+	l := maillist.List{
+		AccountID: a.ID,
+		Name:      "TestMultipleSessions",
+	}
+	if err = s[0].InsertList(&l); err != nil {
+		t.Fatalf("Could not insert list: %v\n", err)
+	}
+	defer s[0].DeleteList(l.ID)
+
+	const n = 40
+	for i := 0; i < n; i++ {
+		sub := maillist.Subscriber{
+			AccountID: a.ID,
+			FirstName: "Multi",
+			LastName:  "Session",
+			Email:     fmt.Sprintf("session%d@example.com", i),
+		}
+		if err = s[0].InsertSubscriber(&sub); err != nil {
+			t.Fatalf("Could not insert subscriber: %v\n", err)
+		}
+		defer s[0].DeleteSubscriber(sub.ID)
+
+		if err = s[0].AddSubscriberToList(l.ID, sub.ID); err != nil {
+			t.Fatalf("Could not add subscriber to list: %v\n", err)
+		}
+	}
+
+	c := maillist.Campaign{
+		AccountID: a.ID,
+		Subject:   "TestMultipleSessions",
+		Body:      "Hi {{.FirstName}}",
+		Address:   "123 fake st",
+		Scheduled: time.Now().Unix(),
+	}
+	if err = s[0].InsertCampaign(&c, []int64{l.ID}, nil); err != nil {
+		t.Fatalf("Could not insert campaign: %v\n", err)
+	}
+
+	for i := 0; mailers[0].total()+mailers[1].total() < n; i++ {
+		if i == 100 {
+			t.Fatalf("Timed out waiting for e-mails")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	// give any duplicates time to be sent
+	time.Sleep(time.Second)
+
+	for i := 0; i < n; i++ {
+		address := fmt.Sprintf("session%d@example.com", i)
+		if count := mailers[0].sent[address] + mailers[1].sent[address]; count != 1 {
+			t.Errorf("%s was sent %d e-mails, want 1", address, count)
+		}
+	}
+	for i, m := range mailers {
+		if m.total() == 0 {
+			t.Errorf("session %d sent no e-mails", i)
+		}
+	}
+}
+
+func TestExpiredClaim(t *testing.T) {
+	var (
+		err error
+		s1  *maillist.Session
+		s2  *maillist.Session
+	)
+
+	// the first session claims the message then hangs, while the second
+	// only sends it once the first's lease has expired
+	blocked := blockMailer{make(chan struct{}, 1), make(chan struct{})}
+	config := maillist.Config{
+		DatabaseAddress: os.Getenv("MAILLIST_DATABASE"),
+		UnsubscribeURL:  "https://myeventarc.localhost/unsubscribe",
+		Mailer:          blocked,
+	}
+	if s1, err = maillist.OpenSession(&config); err != nil {
+		t.Fatalf("Could not open session: %v", err)
+	}
+	defer s1.Close()
+	defer close(blocked.release)
+
+	a := maillist.Account{
+		ApplicationID: 0xdead0023,
+		FirstName:     "Test",
+		LastName:      "ExpiredClaim",
+		Email:         "testexpiredclaim@example.com",
+	}
+	if err = s1.InsertAccount(&a); err != nil {
+		t.Fatalf("Could not insert account: %v\n", err)
+	}
+	defer s1.DeleteAccount(a.ID)
+
+	id, err := s1.SendTransactional(&maillist.Transactional{
+		AccountID: a.ID,
+		Subject:   "TestExpiredClaim",
+		Body:      "Hi {{.FirstName}}",
+		Address:   "123 fake st",
+		Email:     "expired.claim@example.com",
+		FirstName: "Expired",
+		LastName:  "Claim",
+	})
+	if err != nil {
+		t.Fatalf("Could not send transactional e-mail: %v\n", err)
+	}
+	defer func() {
+		if sub, err := s1.GetSubscriberByEmail("expired.claim@example.com", a.ID); err == nil {
+			s1.DeleteSubscriber(sub.ID)
+		}
+	}()
+
+	select {
+	case <-blocked.started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for send")
+	}
+
+	db, err := sql.Open("mysql", os.Getenv("MAILLIST_DATABASE"))
+	if err != nil {
+		t.Fatalf("Could not open database: %v", err)
+	}
+	defer db.Close()
+	if _, err = db.Exec("UPDATE message SET lease_expires=1 WHERE campaign_id=?", id); err != nil {
+		t.Fatalf("Could not expire claim: %v", err)
+	}
+
+	mailer := make(chanMailer, 2)
+	config.Mailer = mailer
+	config.PollInterval = 500 * time.Millisecond
+	if s2, err = maillist.OpenSession(&config); err != nil {
+		t.Fatalf("Could not open session: %v", err)
+	}
+	defer s2.Close()
+
+	select {
+	case e := <-mailer:
+		if e.To.Address != "expired.claim@example.com" {
+			t.Errorf("got e-mail to %s", e.To.Address)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expired claim wasn't sent by another session")
+	}
+
+	m := waitForTransactional(t, s2, id, func(m *maillist.Message) bool {
+		return m.Status == "sent"
+	})
+	if m.Status != "sent" || m.Owner == "" || strings.HasPrefix(m.Owner, s1.InstanceID()) {
+		t.Errorf("got status %s owned by %s, want sent by %s", m.Status, m.Owner, s2.InstanceID())
+	}
+
+	select {
+	case e := <-mailer:
+		t.Errorf("e-mail to %s was sent twice", e.To.Address)
+	case <-time.After(time.Second):
+	}
+}
+
+func TestLocalTimeRecurrence(t *testing.T) {
+	var (
+		err error
+		s   *maillist.Session
+	)
+
+	mailer := make(chanMailer, 2)
+	config := maillist.Config{
+		DatabaseAddress: os.Getenv("MAILLIST_DATABASE"),
+		UnsubscribeURL:  "https://myeventarc.localhost/unsubscribe",
+		Mailer:          mailer,
+	}
+
+	if s, err = maillist.OpenSession(&config); err != nil {
+		t.Fatalf("Could not open session: %v", err)
+	}
+	defer s.Close()
+
+	a := maillist.Account{
+		ApplicationID: 0xdead0024,
+		FirstName:     "Test",
+		LastName:      "LocalTimeRecurrence",
+		Email:         "testlocaltimerecurrence@example.com",
+		Timezone:      "UTC",
+	}
+	if err = s.InsertAccount(&a); err != nil {
+		t.Fatalf("Could not insert account: %v\n", err)
+	}
+	defer s.DeleteAccount(a.ID)
+
+	l := maillist.List{
+		AccountID: a.ID,
+		Name:      "TestLocalTimeRecurrence",
+	}
+	if err = s.InsertList(&l); err != nil {
+		t.Fatalf("Could not insert list: %v\n", err)
+	}
+	defer s.DeleteList(l.ID)
+
+	for _, sub := range []maillist.Subscriber{
+		{FirstName: "Kiri", Email: "kiri.recurrence@example.com", Timezone: "Pacific/Kiritimati"},
+		{FirstName: "Uta", Email: "uta.recurrence@example.com"},
+	} {
+		sub.AccountID = a.ID
+		sub.LastName = "Recurrence"
+		if err = s.InsertSubscriber(&sub); err != nil {
+			t.Fatalf("Could not insert subscriber: %v\n", err)
+		}
+		defer s.DeleteSubscriber(sub.ID)
+
+		if err = s.AddSubscriberToList(l.ID, sub.ID); err != nil {
+			t.Fatalf("Could not add subscriber to list: %v\n", err)
+		}
+	}
+
+	// the occurrence is due now in Kiribati, 14 hours ahead of UTC, so must
+	// be spawned that early
+	c := maillist.Campaign{
+		AccountID:       a.ID,
+		Subject:         "TestLocalTimeRecurrence",
+		Body:            "Hi {{.FirstName}}",
+		Address:         "123 fake st",
+		Scheduled:       time.Now().Add(14 * time.Hour).Truncate(time.Minute).Unix(),
+		LocalTime:       true,
+		Recurrence:      "* * * * *",
+		RecurrenceLimit: 1,
+	}
+	if err = s.InsertCampaign(&c, []int64{l.ID}, nil); err != nil {
+		t.Fatalf("Could not insert campaign: %v\n", err)
+	}
+	defer s.CancelCampaign(c.ID)
+
+	select {
+	case e := <-mailer:
+		if e.To.Address != "kiri.recurrence@example.com" {
+			t.Errorf("got email to %s, want it to be sent to Kiribati first", e.To.Address)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for email")
+	}
+
+	select {
+	case e := <-mailer:
+		t.Errorf("got email to %s, before the scheduled time in UTC", e.To.Address)
+	case <-time.After(2 * time.Second):
+	}
+
+	cs, err := s.GetCampaignOccurrences(c.ID)
+	if err != nil {
+		t.Fatalf("Could not get occurrences: %v\n", err)
+	}
+	for _, o := range cs {
+		s.CancelCampaign(o.ID)
+	}
+	if len(cs) != 1 || !cs[0].LocalTime || cs[0].Scheduled != c.Scheduled {
+		t.Errorf("got occurrences %+v, want one at local time %d", cs, c.Scheduled)
+	}
+}
+
+// rejectMailer permanently rejects e-mails to one address, and passes the
+// rest on
+type rejectMailer struct {
+	chanMailer
+	reject string
+}
+
+func (m rejectMailer) Send(ctx context.Context, e *maillist.Email) error {
+	if e.To.Address == m.reject {
+		return &maillist.PermanentError{Err: errors.New("recipient rejected")}
+	}
+	return m.chanMailer.Send(ctx, e)
+}
+
+func TestWarmupRefund(t *testing.T) {
+	var (
+		err error
+		s   *maillist.Session
+		buf logger
+	)
+
+	mailer := rejectMailer{make(chanMailer, 2), "rejected@warmuprefund.example.com"}
+	config := maillist.Config{
+		DatabaseAddress: os.Getenv("MAILLIST_DATABASE"),
+		Logger:          &buf,
+		UnsubscribeURL:  "https://myeventarc.localhost/unsubscribe",
+		Mailer:          mailer,
+	}
+
+	if s, err = maillist.OpenSession(&config); err != nil {
+		t.Fatalf("Could not open session: %v", err)
+	}
+	defer s.Close()
+
+	a := maillist.Account{
+		ApplicationID: 0xdead0025,
+		FirstName:     "Test",
+		LastName:      "WarmupRefund",
+		Email:         "testwarmuprefund@example.com",
+		Warmup:        "1",
+	}
+	if err = s.InsertAccount(&a); err != nil {
+		t.Fatalf("Could not insert account: %v\n", err)
+	}
+	defer s.DeleteAccount(a.ID)
+
+	l := maillist.List{
+		AccountID: a.ID,
+		Name:      "TestWarmupRefund",
+	}
+	if err = s.InsertList(&l); err != nil {
+		t.Fatalf("Could not insert list: %v\n", err)
+	}
+	defer s.DeleteList(l.ID)
+
+	// the rejected subscriber is sent to first, and shouldn't use up the
+	// day's single message
+	for _, name := range []string{"rejected", "accepted"} {
+		sub := maillist.Subscriber{
+			AccountID: a.ID,
+			FirstName: name,
+			LastName:  "WarmupRefund",
+			Email:     name + "@warmuprefund.example.com",
+		}
+		if err = s.InsertSubscriber(&sub); err != nil {
+			t.Fatalf("Could not insert subscriber: %v\n", err)
+		}
+		defer s.DeleteSubscriber(sub.ID)
+
+		if err = s.AddSubscriberToList(l.ID, sub.ID); err != nil {
+			t.Fatalf("Could not add subscriber to list: %v\n", err)
+		}
+	}
+
+	c := maillist.Campaign{
+		AccountID: a.ID,
+		Subject:   "TestWarmupRefund",
+		Body:      "Hi {{.FirstName}}",
+		Address:   "123 fake st",
+		Scheduled: time.Now().Unix(),
+	}
+	if err = s.InsertCampaign(&c, []int64{l.ID}, nil); err != nil {
+		t.Fatalf("Could not insert campaign: %v\n", err)
+	}
+	defer s.CancelCampaign(c.ID)
+
+	select {
+	case e := <-mailer.chanMailer:
+		if e.To.Address != "accepted@warmuprefund.example.com" {
+			t.Errorf("got e-mail to %s", e.To.Address)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("e-mail wasn't sent after the day's first message was rejected")
+	}
+}
+
+func TestDeletedAccount(t *testing.T) {
+	var (
+		err error
+		s   *maillist.Session
+		buf logger
+	)
+
+	mailer := make(chanMailer, 1)
+	config := maillist.Config{
+		DatabaseAddress: os.Getenv("MAILLIST_DATABASE"),
+		Logger:          &buf,
+		UnsubscribeURL:  "https://myeventarc.localhost/unsubscribe",
+		Mailer:          mailer,
+	}
+
+	if s, err = maillist.OpenSession(&config); err != nil {
+		t.Fatalf("Could not open session: %v", err)
+	}
+	defer s.Close()
+
+	a := maillist.Account{
+		ApplicationID: 0xdead0026,
+		FirstName:     "Test",
+		LastName:      "DeletedAccount",
+		Email:         "testdeletedaccount@example.com",
+	}
+	if err = s.InsertAccount(&a); err != nil {
+		t.Fatalf("Could not insert account: %v\n", err)
+	}
+
+	l := maillist.List{
+		AccountID: a.ID,
+		Name:      "TestDeletedAccount",
+	}
+	if err = s.InsertList(&l); err != nil {
+		t.Fatalf("Could not insert list: %v\n", err)
+	}
+	defer s.DeleteList(l.ID)
+
+	sub := maillist.Subscriber{
+		AccountID: a.ID,
+		FirstName: "Dee",
+		LastName:  "Leted",
+		Email:     "dee.leted@example.com",
+	}
+	if err = s.InsertSubscriber(&sub); err != nil {
+		t.Fatalf("Could not insert subscriber: %v\n", err)
+	}
+	defer s.DeleteSubscriber(sub.ID)
+
+	if err = s.AddSubscriberToList(l.ID, sub.ID); err != nil {
+		t.Fatalf("Could not add subscriber to list: %v\n", err)
+	}
+
+	c := maillist.Campaign{
+		AccountID: a.ID,
+		Subject:   "TestDeletedAccount",
+		Body:      "Hi {{.FirstName}}",
+		Address:   "123 fake st",
+		Scheduled: time.Now().Add(time.Second).Unix(),
+	}
+	if err = s.InsertCampaign(&c, []int64{l.ID}, nil); err != nil {
+		t.Fatalf("Could not insert campaign: %v\n", err)
+	}
+
+	// the campaign's messages are queued after its account has gone, and
+	// should fail rather than be retried
+	if err = s.DeleteAccount(a.ID); err != nil {
+		t.Fatalf("Could not delete account: %v\n", err)
+	}
+
+	select {
+	case e := <-mailer:
+		t.Errorf("got e-mail to %s from a deleted account", e.To.Address)
+	case <-time.After(4 * time.Second):
+	}
+
+	if c2, err := s.GetCampaign(c.ID); err != nil {
+		t.Fatalf("Could not get campaign: %v\n", err)
+	} else if c2.Status != "failed" {
+		t.Errorf("got campaign status '%s', want 'failed'", c2.Status)
+	}
+}
+
+func TestExpansionFailure(t *testing.T) {
+	var (
+		err error
+		s   *maillist.Session
+		buf logger
+	)
+
+	// attendees without a last name can't be added as subscribers, so the
+	// campaign sent to the event can never be expanded
+	getAttendees := func(eventID int64) []*maillist.Subscriber {
+		return []*maillist.Subscriber{{
+			FirstName: "Nameless",
+			Email:     "nameless@example.com",
+		}}
+	}
+
+	mailer := make(chanMailer, 1)
+	config := maillist.Config{
+		DatabaseAddress:      os.Getenv("MAILLIST_DATABASE"),
+		GetAttendeesCallback: getAttendees,
+		Logger:               &buf,
+		UnsubscribeURL:       "https://myeventarc.localhost/unsubscribe",
+		Mailer:               mailer,
+		MaxAttempts:          1,
+	}
+
+	if s, err = maillist.OpenSession(&config); err != nil {
+		t.Fatalf("Could not open session: %v", err)
+	}
+	defer s.Close()
+
+	a := maillist.Account{
+		ApplicationID: 0xdead0027,
+		FirstName:     "Test",
+		LastName:      "ExpansionFailure",
+		Email:         "testexpansionfailure@example.com",
+	}
+	if err = s.InsertAccount(&a); err != nil {
+		t.Fatalf("Could not insert account: %v\n", err)
+	}
+	defer s.DeleteAccount(a.ID)
+
+	l := maillist.List{
+		AccountID: a.ID,
+		Name:      "TestExpansionFailure",
+	}
+	if err = s.InsertList(&l); err != nil {
+		t.Fatalf("Could not insert list: %v\n", err)
+	}
+	defer s.DeleteList(l.ID)
+
+	sub := maillist.Subscriber{
+		AccountID: a.ID,
+		FirstName: "Ex",
+		LastName:  "Panded",
+		Email:     "ex.panded@example.com",
+	}
+	if err = s.InsertSubscriber(&sub); err != nil {
+		t.Fatalf("Could not insert subscriber: %v\n", err)
+	}
+	defer s.DeleteSubscriber(sub.ID)
+
+	if err = s.AddSubscriberToList(l.ID, sub.ID); err != nil {
+		t.Fatalf("Could not add subscriber to list: %v\n", err)
+	}
+
+	// the broken campaign is due first
+	broken := maillist.Campaign{
+		AccountID: a.ID,
+		Subject:   "TestExpansionFailure broken",
+		Body:      "Hi {{.FirstName}}",
+		Address:   "123 fake st",
+		Scheduled: time.Now().Add(-time.Second).Unix(),
+	}
+	if err = s.InsertCampaign(&broken, nil, []int64{5}); err != nil {
+		t.Fatalf("Could not insert campaign: %v\n", err)
+	}
+
+	c := maillist.Campaign{
+		AccountID: a.ID,
+		Subject:   "TestExpansionFailure",
+		Body:      "Hi {{.FirstName}}",
+		Address:   "123 fake st",
+		Scheduled: time.Now().Unix(),
+	}
+	if err = s.InsertCampaign(&c, []int64{l.ID}, nil); err != nil {
+		t.Fatalf("Could not insert campaign: %v\n", err)
+	}
+
+	select {
+	case e := <-mailer:
+		if e.To.Address != sub.Email {
+			t.Errorf("got e-mail to %s, want %s", e.To.Address, sub.Email)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("campaign was not sent after another failed to expand:\n%s", buf.String())
+	}
+
+	if c2, err := s.GetCampaign(broken.ID); err != nil {
+		t.Fatalf("Could not get campaign: %v\n", err)
+	} else if c2.Status != "failed" {
+		t.Errorf("got campaign status '%s', want 'failed'", c2.Status)
+	}
+}
+
 func (l *logger) Error(a ...interface{}) {
 	fmt.Fprintln((*bytes.Buffer)(l), a...)
 }
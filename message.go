@@ -1,155 +1,260 @@
 package maillist
 
 import (
-	"bytes"
-	"database/sql"
-	"errors"
+	"context"
 	"fmt"
-	"html/template"
-	"strings"
-
-	"github.com/sendgrid/sendgrid-go"
-	"github.com/sendgrid/sendgrid-go/helpers/mail"
+	"time"
 )
 
 // Message is a single email. It keeps track of whether the message has been
-// sent or not.
+// sent or not. Failed attempts to send are counted, and the message is retried
+// no earlier than NextAttempt until it has failed Config.MaxAttempts times.
+// While a session is sending the message it is marked `sending`, and Owner
+// identifies the claim until LeaseExpires. Domain is the domain of the
+// subscriber's e-mail address, by which sending is throttled.
 type Message struct {
 	SubscriberID int64  `db:"subscriber_id" validate:"required"`
 	CampaignID   int64  `db:"campaign_id" validate:"required"`
-	Status       string `db:"status" validate:"eq=pending|eq=sent|eq=failed|eq=cancelled"`
+	Status       string `db:"status" validate:"eq=pending|eq=sending|eq=sent|eq=failed|eq=cancelled"`
+	Attempts     int    `db:"attempts"`
+	LastError    string `db:"last_error"`
+	NextAttempt  int64  `db:"next_attempt"`
+	Owner        string `db:"owner"`
+	LeaseExpires int64  `db:"lease_expires"`
+	Domain       string `db:"domain"`
 	CreateTime   int64  `db:"create_time" validate:"required"`
 }
 
 // InsertMessage inserts a message into the database. It's ID field will be
 // updated.
 func (s *Session) InsertMessage(m *Message) error {
-	return s.insert(m)
+	return s.InsertMessageContext(context.Background(), m)
 }
 
-// pendingMessage retrieves a single message that is waiting to be sent
-func pendingMessage(s *Session) (*Message, error) {
-	var m Message
-	query := fmt.Sprintf("select %s from message where status='pending' limit 1",
-		s.selectString(&m))
-	err := s.dbmap.SelectOne(&m, query)
-
-	if err == sql.ErrNoRows {
-		return nil, ErrNotFound
-
-	} else if err != nil {
-		return nil, err
+// InsertMessageContext is like InsertMessage but with a context
+func (s *Session) InsertMessageContext(ctx context.Context, m *Message) error {
+	if m.Domain == "" {
+		sub, err := s.GetSubscriberContext(ctx, m.SubscriberID)
+		if err != nil {
+			return fmt.Errorf("couldn't get subscriber: %v", err)
+		}
+		m.Domain = emailDomain(sub.Email)
 	}
-	return &m, nil
+	return s.insert(ctx, m)
 }
 
-// sendMessage sends a single message to it's destination
-func (s *Session) sendMessage(m *Message) error {
-	var email *mail.SGMailV3
+// sendMessage sends a single message to it's destination. Failure to build or
+// send the email is recorded against the message rather than returned, unless
+// the context ended first.
+func (s *Session) sendMessage(ctx context.Context, m *Message) error {
+	var email *Email
 	var err error
 	var spam bool
 
-	if email, err = buildEmail(s, m); err != nil {
-		return err
+	if email, err = buildEmail(ctx, s, m); err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return s.messageFailed(ctx, err, m)
 	}
 
-	if spam, err = s.HasReportedSpam(email.Personalizations[0].To[0].Address); err != nil {
+	if spam, err = s.HasReportedSpamContext(ctx, email.To.Address); err != nil {
 		return err
 
 	} else if spam {
-		return nil
+		return s.setMessageStatus(ctx, "cancelled", m)
 	}
 
-	if s.config.JustPrint {
-		s.info(string(printEmail(email)))
+	if err = s.mailer.Send(ctx, email); err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return s.messageFailed(ctx, err, m)
+	}
 
-	} else if err = s.send(email); err != nil {
+	// the e-mail has gone, so record it even if the context has since ended
+	// rather than leave it to be sent again
+	ctx = context.Background()
+	if err = s.setMessageStatus(ctx, "sent", m); err != nil {
 		return err
 	}
 
-	if _, err = s.dbmap.Exec("update message set status='sent' where subscriber_id=? and campaign_id=?",
-		m.SubscriberID, m.CampaignID); err != nil {
-		return fmt.Errorf("couldn't update message status: %v", err)
+	if err = s.updateCampaignStatus(ctx, m.CampaignID); err != nil {
+		return fmt.Errorf("couldn't update campaign status: %v", err)
 	}
+	return nil
+}
 
-	if err = s.updateCampaignStatus(m.CampaignID); err != nil {
-		return fmt.Errorf("couldn't update campaign status: %v", err)
+// setMessageStatus updates the status of one or more claimed messages, with a
+// single update for each claim. Messages which are no longer claimed by their
+// owner (e.g. because their campaign was cancelled) are left unchanged.
+func (s *Session) setMessageStatus(ctx context.Context, status string, ms ...*Message) error {
+	for _, group := range groupMessages(ms, func(m *Message) interface{} { return nil }) {
+		updateSQL := fmt.Sprintf(`
+UPDATE message
+	SET status=?
+
+WHERE campaign_id=?
+	AND status='sending'
+	AND owner=?
+	AND subscriber_id IN (%s)`,
+			sqlPlaceholders(len(group)))
+
+		args := []interface{}{status, group[0].CampaignID, group[0].Owner}
+		if _, err := s.dbmap.WithContext(ctx).Exec(updateSQL, append(args, subscriberIDs(group)...)...); err != nil {
+			return fmt.Errorf("couldn't update message status: %v", err)
+		}
 	}
 	return nil
 }
 
-func (s *Session) send(m *mail.SGMailV3) error {
-	request := sendgrid.GetRequest(s.config.SendGridAPIKey, "/v3/mail/send", "https://api.sendgrid.com")
-	request.Method = "POST"
-	request.Body = mail.GetRequestBody(m)
-	response, err := sendgrid.API(request)
-	if err != nil {
-		s.error(err)
-		return err
+// maxBackoff is the longest delay between attempts to send a message
+const maxBackoff = 24 * time.Hour
+
+// messageFailed records a failed attempt to send messages of a single
+// campaign. Each is retried after an exponentially increasing delay, unless
+// the error is permanent or the message has no attempts remaining, in which
+// case it is marked failed. Messages with the same outcome are updated
+// together.
+func (s *Session) messageFailed(ctx context.Context, sendErr error, ms ...*Message) error {
+	var failed bool
+	now := time.Now()
+
+	for _, m := range ms {
+		m.Attempts++
+		m.LastError = sendErr.Error()
+
+		if _, permanent := sendErr.(*PermanentError); permanent || m.Attempts >= s.config.MaxAttempts {
+			m.Status = "failed"
+			failed = true
+		} else {
+			m.Status = "pending"
+			backoff := s.config.RetryBackoff << uint(m.Attempts-1)
+			if backoff > maxBackoff || backoff <= 0 {
+				backoff = maxBackoff
+			}
+			m.NextAttempt = now.Add(backoff).Unix()
+		}
 	}
-	if response.StatusCode < 200 || response.StatusCode >= 300 {
-		err := errors.New(response.Body)
-		s.error(err)
-		return err
+
+	type outcome struct {
+		status      string
+		attempts    int
+		nextAttempt int64
+	}
+	groups := groupMessages(ms, func(m *Message) interface{} {
+		return outcome{m.Status, m.Attempts, m.NextAttempt}
+	})
+	for _, group := range groups {
+		updateSQL := fmt.Sprintf(`
+UPDATE message
+	SET status=?, attempts=?, last_error=?, next_attempt=?
+
+WHERE campaign_id=?
+	AND status='sending'
+	AND owner=?
+	AND subscriber_id IN (%s)`,
+			sqlPlaceholders(len(group)))
+
+		m := group[0]
+		args := []interface{}{m.Status, m.Attempts, m.LastError, m.NextAttempt, m.CampaignID, m.Owner}
+		if _, err := s.dbmap.WithContext(ctx).Exec(updateSQL, append(args, subscriberIDs(group)...)...); err != nil {
+			return fmt.Errorf("couldn't update message status: %v", err)
+		}
 	}
 
+	if len(ms) > 0 {
+		s.error(fmt.Sprintf("couldn't send %d message(s) for campaign %d:", len(ms), ms[0].CampaignID), sendErr)
+	}
+
+	if failed {
+		if err := s.updateCampaignStatus(ctx, ms[0].CampaignID); err != nil {
+			return fmt.Errorf("couldn't update campaign status: %v", err)
+		}
+	}
 	return nil
 }
 
-// buildEmail creates a new email in the format expected by sendgrid
-func buildEmail(s *Session, m *Message) (*mail.SGMailV3, error) {
-	sub, err := s.GetSubscriber(m.SubscriberID)
+// groupMessages groups messages by their claim and a key, keeping the order
+// in which each group first appears
+func groupMessages(ms []*Message, key func(*Message) interface{}) [][]*Message {
+	type groupKey struct {
+		campaignID int64
+		owner      string
+		key        interface{}
+	}
+	index := make(map[groupKey]int)
+	var groups [][]*Message
+	for _, m := range ms {
+		k := groupKey{m.CampaignID, m.Owner, key(m)}
+		i, ok := index[k]
+		if !ok {
+			i = len(groups)
+			index[k] = i
+			groups = append(groups, nil)
+		}
+		groups[i] = append(groups[i], m)
+	}
+	return groups
+}
+
+// subscriberIDs returns the subscriber IDs of messages, as query arguments
+func subscriberIDs(ms []*Message) []interface{} {
+	ids := make([]interface{}, len(ms))
+	for i, m := range ms {
+		ids[i] = m.SubscriberID
+	}
+	return ids
+}
+
+// buildEmail creates a new email from a message, ready to be passed to the
+// session's mailer
+func buildEmail(ctx context.Context, s *Session, m *Message) (*Email, error) {
+	sub, err := s.GetSubscriberContext(ctx, m.SubscriberID)
 	if err != nil {
 		return nil, fmt.Errorf("couldn't get subscriber: %v", err)
 	}
 
-	campaign, err := s.GetCampaign(m.CampaignID)
+	campaign, err := s.GetCampaignContext(ctx, m.CampaignID)
 	if err != nil {
 		return nil, fmt.Errorf("couldn't get campaign %d: %v", m.CampaignID, err)
 	}
 
-	account, err := s.GetAccount(campaign.AccountID)
+	account, err := s.GetAccountContext(ctx, campaign.AccountID)
 	if err != nil {
 		return nil, fmt.Errorf("couldn't get account: %v", err)
 	}
 
-	to := mail.NewEmail(sub.FirstName+" "+sub.LastName,
-		sub.Email)
-	subject := campaign.Subject
-	if s.templates[m.CampaignID] == nil {
-		t, err := template.New("").Parse(campaign.Body)
-		if err != nil {
-			return nil, err
-		}
-		s.templates[m.CampaignID] = t
-	}
-	var buf bytes.Buffer
-	token, _ := s.UnsubscribeToken(sub)
-	bodyStruct := struct {
-		FirstName, LastName, UnsubscribeURL string
-	}{sub.FirstName, sub.LastName, s.config.UnsubscribeURL + "/" + token}
-
-	if err := s.templates[m.CampaignID].Execute(&buf, &bodyStruct); err != nil {
+	data, err := subscriberData(ctx, s, sub)
+	if err != nil {
 		return nil, err
 	}
-	contentType := "text/plain"
-	if strings.Contains(campaign.Body, "DOCTYPE") {
-		contentType = "text/html"
+	return newEmail(s, campaign, account, sub, data)
+}
+
+// subscriberData returns the template data for a subscriber
+func subscriberData(ctx context.Context, s *Session, sub *Subscriber) (*templateData, error) {
+	token, _ := s.UnsubscribeTokenContext(ctx, sub)
+	attrs, err := s.GetSubscriberAttributesContext(ctx, sub.ID)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't get subscriber attributes: %v", err)
 	}
-	content := mail.NewContent(contentType, buf.String())
-	from := mail.NewEmail(account.FirstName+" "+account.LastName,
-		account.Email)
-	return mail.NewV3MailInit(from, subject, to, content), nil
+	return &templateData{sub.FirstName, sub.LastName, s.config.UnsubscribeURL + "/" + token, attrs}, nil
 }
 
-// printEmail just prints an email to stderr. It is useful for
-// debugging/logging
-func printEmail(m *mail.SGMailV3) []byte {
-	s := fmt.Sprintln("Email to send")
-	s += fmt.Sprintf("To: %s (%s)\n",
-		m.Personalizations[0].To[0].Address,
-		m.Personalizations[0].To[0].Name)
-	s += fmt.Sprintf("From: %s (%s)\n", m.From.Address, m.From.Name)
-	s += fmt.Sprintf("Subject: %s\nBody: %s\n", m.Subject, m.Content[0].Value)
-	return []byte(s)
+// newEmail renders a campaign for a single subscriber
+func newEmail(s *Session, campaign *Campaign, account *Account, sub *Subscriber, data *templateData) (*Email, error) {
+	// retrying won't fix a broken template
+	r, err := renderCampaign(s, campaign, data)
+	if err != nil {
+		return nil, &PermanentError{err}
+	}
+
+	return &Email{
+		From:    Address{account.FirstName + " " + account.LastName, account.Email},
+		To:      Address{sub.FirstName + " " + sub.LastName, sub.Email},
+		Subject: r.subject,
+		Body:    r.text,
+		HTML:    r.html,
+	}, nil
 }
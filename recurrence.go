@@ -0,0 +1,184 @@
+package maillist
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// prepareRecurrence checks the recurrence rule of a campaign being inserted or
+// updated. A scheduled campaign with a rule becomes a recurring campaign,
+// whose Scheduled time is moved to its first occurrence no earlier than
+// Scheduled.
+func prepareRecurrence(c *Campaign) error {
+	if c.Recurrence == "" {
+		if c.Status == "recurring" {
+			return fmt.Errorf("recurring campaign '%s' has no recurrence rule", c.Subject)
+		}
+		return nil
+	}
+
+	next, err := NextRecurrence(c.Recurrence, time.Unix(c.Scheduled, 0).Add(-time.Second))
+	if err != nil {
+		return err
+	}
+	if c.RecurrenceEnd != 0 && next.Unix() > c.RecurrenceEnd {
+		return fmt.Errorf("recurring campaign '%s' has no occurrences before it ends", c.Subject)
+	}
+
+	if c.Status == "scheduled" {
+		c.Status = "recurring"
+	}
+	if c.Status == "recurring" {
+		c.Scheduled = next.Unix()
+	}
+	return nil
+}
+
+// GetCampaignOccurrences returns the campaigns spawned by a recurring campaign
+func (s *Session) GetCampaignOccurrences(parentID int64) ([]*Campaign, error) {
+	return s.GetCampaignOccurrencesContext(context.Background(), parentID)
+}
+
+// GetCampaignOccurrencesContext is like GetCampaignOccurrences but with a
+// context
+func (s *Session) GetCampaignOccurrencesContext(ctx context.Context, parentID int64) ([]*Campaign, error) {
+
+	selectSQL := fmt.Sprintf(`
+SELECT %s
+	FROM campaign
+
+WHERE parent_id=? AND status != 'deleted'
+
+ORDER BY scheduled`,
+		s.selectString(Campaign{}))
+
+	var cs []*Campaign
+	if _, err := s.dbmap.WithContext(ctx).Select(&cs, selectSQL, parentID); err != nil {
+		return nil, err
+
+	} else if len(cs) == 0 {
+		return nil, ErrNotFound
+	}
+
+	return cs, nil
+}
+
+// spawnDueRecurrences schedules the next occurrence of every recurring
+// campaign which is due
+func (s *Session) spawnDueRecurrences(ctx context.Context) {
+	for !s.stopping() {
+		c, err := getDueRecurrence(ctx, s)
+		if err == ErrNotFound {
+			return
+
+		} else if err != nil {
+			s.error("couldn't retrieve due recurring campaign:", err)
+			return
+		}
+
+		if err = s.spawnOccurrence(ctx, c); err != nil {
+			s.error("couldn't schedule recurring campaign:", err)
+			return
+		}
+	}
+}
+
+// getDueRecurrence retrieves a recurring campaign whose next occurrence is due.
+// As with getDueCampaign, occurrences sent at local time are due as soon as
+// their time is reached in any timezone.
+func getDueRecurrence(ctx context.Context, s *Session) (*Campaign, error) {
+	var c Campaign
+	selectSQL := fmt.Sprintf(`
+SELECT %s
+	FROM campaign
+
+WHERE status='recurring'
+	AND scheduled<=IF(local_time, ?, ?)
+
+LIMIT 1`,
+		s.selectString(&c))
+
+	now := time.Now()
+	err := s.dbmap.WithContext(ctx).SelectOne(&c, selectSQL, now.Add(maxUTCOffset).Unix(), now.Unix())
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+
+	} else if err != nil {
+		return nil, err
+	}
+
+	return &c, nil
+}
+
+// spawnOccurrence schedules a copy of a recurring campaign for its current
+// occurrence, and advances it to the next after now. If occurrences were
+// missed while no session was running, only one is sent, scheduled at the
+// earliest of them, and the rest are skipped.
+func (s *Session) spawnOccurrence(ctx context.Context, c *Campaign) error {
+	schedule, err := parseCron(c.Recurrence)
+	if err != nil {
+		return err
+	}
+
+	after := time.Now()
+	if scheduled := time.Unix(c.Scheduled, 0); scheduled.After(after) {
+		after = scheduled
+	}
+	next := schedule.next(after)
+
+	status, scheduled := "recurring", next.Unix()
+	if next.IsZero() ||
+		(c.RecurrenceEnd != 0 && scheduled > c.RecurrenceEnd) ||
+		(c.RecurrenceLimit != 0 && c.Occurrences+1 >= c.RecurrenceLimit) {
+		status, scheduled = "sent", c.Scheduled
+	}
+
+	occurrence := *c
+	occurrence.ID = 0
+	occurrence.Status = "scheduled"
+	occurrence.CreateTime = time.Now().Unix()
+	occurrence.Recurrence = ""
+	occurrence.RecurrenceEnd = 0
+	occurrence.RecurrenceLimit = 0
+	occurrence.Occurrences = 0
+	occurrence.ParentID = c.ID
+	if err = validate.Struct(&occurrence); err != nil {
+		return err
+	}
+
+	tx, err := s.dbmap.Begin()
+	if err != nil {
+		return err
+	}
+
+	// the recurring campaign may have been changed or cancelled since it was
+	// retrieved
+	updateSQL := `
+UPDATE campaign
+	SET status=?, scheduled=?, occurrences=occurrences+1
+
+WHERE id=?
+	AND status='recurring'
+	AND scheduled=?`
+
+	r, err := tx.WithContext(ctx).Exec(updateSQL, status, scheduled, c.ID, c.Scheduled)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if n, err := r.RowsAffected(); err != nil || n != 1 {
+		tx.Rollback()
+		return err
+	}
+
+	if err = tx.WithContext(ctx).Insert(&occurrence); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("couldn't commit occurrence of recurring campaign: %v", err)
+	}
+	return nil
+}
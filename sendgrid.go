@@ -0,0 +1,88 @@
+package maillist
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/sendgrid/rest"
+	"github.com/sendgrid/sendgrid-go"
+	"github.com/sendgrid/sendgrid-go/helpers/mail"
+)
+
+var sendGridClient = &rest.Client{HTTPClient: &http.Client{Timeout: time.Minute}}
+
+// SendGridMailer delivers e-mail through the SendGrid v3 HTTP API
+type SendGridMailer struct {
+	APIKey string
+}
+
+// Send sends a single e-mail
+func (m *SendGridMailer) Send(ctx context.Context, e *Email) error {
+	return m.post(ctx, sendGridMail(e))
+}
+
+// SendBatch sends a batch of e-mails in a single request, using a
+// personalization for each recipient
+func (m *SendGridMailer) SendBatch(ctx context.Context, b *Batch) error {
+	sg := mail.NewV3Mail()
+	sg.SetFrom(mail.NewEmail(b.From.Name, b.From.Address))
+	sg.Subject = b.Subject
+	sg.AddContent(sendGridContent(b.Body, b.HTML)...)
+
+	for _, r := range b.Recipients {
+		p := mail.NewPersonalization()
+		p.AddTos(mail.NewEmail(r.To.Name, r.To.Address))
+		for k, v := range r.Substitutions {
+			p.SetSubstitution(k, v)
+		}
+		sg.AddPersonalizations(p)
+	}
+	return m.post(ctx, sg)
+}
+
+func (m *SendGridMailer) post(ctx context.Context, sg *mail.SGMailV3) error {
+	request := sendgrid.GetRequest(m.APIKey, "/v3/mail/send", "https://api.sendgrid.com")
+	request.Method = "POST"
+	request.Body = mail.GetRequestBody(sg)
+	response, err := sendGridClient.SendWithContext(ctx, request)
+	if err != nil {
+		return err
+	}
+	if response.StatusCode < 200 || response.StatusCode >= 300 {
+		err = errors.New(response.Body)
+
+		// client errors will not be resolved by retrying, except when we
+		// have been rate limited
+		if response.StatusCode < 500 && response.StatusCode != http.StatusTooManyRequests {
+			return &PermanentError{err}
+		}
+		return err
+	}
+
+	return nil
+}
+
+// sendGridMail converts an e-mail to the format expected by SendGrid
+func sendGridMail(e *Email) *mail.SGMailV3 {
+	sg := mail.NewV3Mail()
+	sg.SetFrom(mail.NewEmail(e.From.Name, e.From.Address))
+	sg.Subject = e.Subject
+	sg.AddContent(sendGridContent(e.Body, e.HTML)...)
+
+	p := mail.NewPersonalization()
+	p.AddTos(mail.NewEmail(e.To.Name, e.To.Address))
+	sg.AddPersonalizations(p)
+	return sg
+}
+
+// sendGridContent returns the parts of an e-mail's content. SendGrid requires
+// the plain text part to come first.
+func sendGridContent(text, html string) []*mail.Content {
+	content := []*mail.Content{mail.NewContent("text/plain", text)}
+	if html != "" {
+		content = append(content, mail.NewContent("text/html", html))
+	}
+	return content
+}
@@ -1,9 +1,10 @@
 package maillist
 
 import (
+	"context"
 	"errors"
 	"fmt"
-	"html/template"
+	"sync"
 	"time"
 )
 
@@ -13,19 +14,111 @@ type getAttendeeFunc func(eventID int64) []*Subscriber
 // implementation details
 type Session struct {
 	database
-	config    Config
-	wake      chan bool
-	templates map[int64]*template.Template
+	id      string
+	config  Config
+	mailer  Mailer
+	limiter *rateLimiter
+	domains *domainThrottle
+	queue   *fairQueue
+
+	candidates candidateCache
+
+	// wake and work signal the scheduler and sender respectively that there
+	// may be new work. Both are buffered so that signalling never blocks.
+	wake chan bool
+	work chan bool
+
+	// stop is closed when the session begins shutting down, after which no
+	// new work is started. ctx is done if in-flight work must be abandoned,
+	// and done is closed once the scheduler and sender have exited.
+	stop      chan struct{}
+	ctx       context.Context
+	cancel    context.CancelFunc
+	done      chan struct{}
+	closeOnce sync.Once
+	closeErr  error
+
+	templatesMu sync.Mutex
+	templates   map[int64]*campaignTemplates
+
+	// expandFailures holds the campaigns which couldn't be expanded, until
+	// they are retried. It is only used by the scheduler.
+	expandFailures map[int64]*expandFailure
 }
 
 // Config stores application defined options
 type Config struct {
-	DatabaseAddress      string
-	JustPrint            bool
+	DatabaseAddress string
+
+	// JustPrint logs a short summary of each e-mail instead of sending it.
+	// CaptureDir is usually more useful, as it keeps the complete message.
+	JustPrint bool
+
+	// CaptureDir, if set, writes each e-mail to a file in this directory
+	// instead of sending it. With CaptureMaildir the directory is treated as
+	// a Maildir.
+	CaptureDir     string
+	CaptureMaildir bool
+
 	Logger               Logger
 	GetAttendeesCallback getAttendeeFunc
 	UnsubscribeURL       string
 
+	// Mailer delivers outgoing e-mail. If nil, the first of CaptureDir,
+	// JustPrint, SMTPHost or the SendGrid settings to be set determines how
+	// e-mail is sent.
+	Mailer Mailer
+
+	// SMTPHost, if set, delivers mail through an SMTP relay rather than
+	// SendGrid. See SMTPMailer for the meaning of each setting.
+	SMTPHost     string
+	SMTPPort     int
+	SMTPTLS      string
+	SMTPAuth     string
+	SMTPUsername string
+	SMTPPassword string
+	SMTPTimeout  time.Duration
+
+	// Workers is the number of messages (or batches) sent concurrently. It
+	// defaults to 1.
+	Workers int
+
+	// MaxPerSecond limits the rate at which messages are sent across all
+	// workers. Zero means no limit.
+	MaxPerSecond float64
+
+	// DomainLimits limits the messages per minute sent by this session to
+	// each recipient domain, such as "gmail.com". If nil, DefaultDomainLimits
+	// is used. DefaultDomainLimit applies to all other domains, and zero
+	// means no limit.
+	DomainLimits       map[string]int
+	DefaultDomainLimit int
+
+	// MaxAttempts is the number of times sending a message is attempted
+	// before it is marked failed. It defaults to 5.
+	MaxAttempts int
+
+	// RetryBackoff is the delay before a failed message is first retried. It
+	// doubles with each subsequent attempt, and defaults to one minute.
+	RetryBackoff time.Duration
+
+	// ClaimLease is how long a session may hold messages it is sending
+	// without renewing its claim, before other sessions assume it has died
+	// and claim them. Claims are renewed while their messages are sent. It
+	// defaults to ten minutes.
+	ClaimLease time.Duration
+
+	// LeaderLease is how long the session scheduling campaigns holds that
+	// role without renewing it. Other sessions take over once it expires.
+	// It defaults to three minutes.
+	LeaderLease time.Duration
+
+	// PollInterval is the longest the session sleeps between checks for
+	// work, which picks up changes made by other processes. Campaigns and
+	// retries known to this session are started on time regardless. It
+	// defaults to one minute, and should be shorter than LeaderLease.
+	PollInterval time.Duration
+
 	SendGridAPIKey   string
 	SendGridUsername string
 	SendGridPassword string
@@ -37,7 +130,7 @@ type Logger interface {
 	Info(a ...interface{})
 }
 
-func (c Session) error(a ...interface{}) {
+func (c *Session) error(a ...interface{}) {
 	if c.config.Logger != nil {
 		c.config.Logger.Error(a...)
 	} else {
@@ -46,7 +139,7 @@ func (c Session) error(a ...interface{}) {
 	}
 }
 
-func (c Session) info(a ...interface{}) {
+func (c *Session) info(a ...interface{}) {
 	if c.config.Logger != nil {
 		c.config.Logger.Info(a...)
 	} else {
@@ -66,8 +159,45 @@ func OpenSession(config *Config) (*Session, error) {
 	}
 
 	s.config = *config
+	if s.config.MaxAttempts == 0 {
+		s.config.MaxAttempts = 5
+	}
+	if s.config.RetryBackoff == 0 {
+		s.config.RetryBackoff = time.Minute
+	}
+	if s.config.ClaimLease == 0 {
+		s.config.ClaimLease = 10 * time.Minute
+	}
+	if s.config.LeaderLease == 0 {
+		s.config.LeaderLease = 3 * time.Minute
+	}
+	if s.config.PollInterval == 0 {
+		s.config.PollInterval = time.Minute
+	}
+	s.id = newInstanceID()
+
+	switch {
+	case config.Mailer != nil:
+		s.mailer = config.Mailer
+
+	case config.CaptureDir != "":
+		s.mailer = &FileMailer{Dir: config.CaptureDir, Maildir: config.CaptureMaildir}
+
+	case config.JustPrint:
+		s.mailer = printMailer{&s}
 
-	if !config.JustPrint {
+	case config.SMTPHost != "":
+		s.mailer = &SMTPMailer{
+			Host:     config.SMTPHost,
+			Port:     config.SMTPPort,
+			TLS:      config.SMTPTLS,
+			Auth:     config.SMTPAuth,
+			Username: config.SMTPUsername,
+			Password: config.SMTPPassword,
+			Timeout:  config.SMTPTimeout,
+		}
+
+	default:
 		if config.SendGridAPIKey == "" {
 			return nil, errors.New("maillist: SendGridAPIKey must be set")
 		}
@@ -77,6 +207,7 @@ func OpenSession(config *Config) (*Session, error) {
 		if config.SendGridPassword == "" {
 			return nil, errors.New("maillist: SendGridPassword must be set")
 		}
+		s.mailer = &SendGridMailer{APIKey: config.SendGridAPIKey}
 	}
 
 	if s.config.GetAttendeesCallback == nil {
@@ -93,38 +224,224 @@ func OpenSession(config *Config) (*Session, error) {
 	s.addTable(Message{}, "message")
 	s.addTable(ListSubscriber{}, "list_subscriber")
 
-	s.templates = make(map[int64]*template.Template)
+	s.templates = make(map[int64]*campaignTemplates)
+	s.expandFailures = make(map[int64]*expandFailure)
+	s.limiter = newRateLimiter(config.MaxPerSecond)
+	if s.config.DomainLimits == nil {
+		s.config.DomainLimits = DefaultDomainLimits
+	}
+	s.domains = newDomainThrottle(s.config.DomainLimits, s.config.DefaultDomainLimit)
+	s.queue = newFairQueue()
 
-	s.wake = make(chan bool)
+	s.stop = make(chan struct{})
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	s.done = make(chan struct{})
+	s.wake = make(chan bool, 1)
+	s.work = make(chan bool, 1)
 	go service(&s)
-	s.wake <- true
 
 	return &s, err
 }
 
-// Close closes the session. It blocks until the session is cleanly exited
+// Close closes the session. It blocks until the session is cleanly exited,
+// waiting for any messages being sent to finish.
 func (c *Session) Close() error {
-	close(c.wake)
-	return c.db.Close()
+	return c.Shutdown(context.Background())
+}
+
+// Shutdown closes the session gracefully. No new messages are claimed or
+// campaigns expanded, and Shutdown waits for messages already being sent to
+// finish and have their status recorded before releasing the session's
+// resources. If the context is done first, sending is aborted, unsent messages
+// are returned to the queue and the context's error is returned.
+func (c *Session) Shutdown(ctx context.Context) error {
+	c.closeOnce.Do(func() {
+		close(c.stop)
+
+		select {
+		case <-c.done:
+		case <-ctx.Done():
+			c.closeErr = ctx.Err()
+			c.cancel()
+			<-c.done
+		}
+		c.cancel()
+
+		if m, ok := c.mailer.(idleCloser); ok {
+			m.CloseIdleConnections()
+		}
+		if err := c.releaseLease(context.Background(), schedulerLease); err != nil {
+			c.error("couldn't release scheduler lease:", err)
+		}
+		if err := c.db.Close(); err != nil && c.closeErr == nil {
+			c.closeErr = err
+		}
+	})
+	return c.closeErr
+}
+
+// stopping reports whether the session has begun shutting down
+func (c *Session) stopping() bool {
+	select {
+	case <-c.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// wakeScheduler tells the scheduler that campaigns have changed, so that it
+// re-arms its timer. It never blocks.
+func (s *Session) wakeScheduler() {
+	select {
+	case s.wake <- true:
+	default:
+	}
+}
+
+// wakeSender tells the sender that messages have been queued, so that their
+// campaigns are claimed from. It never blocks.
+func (s *Session) wakeSender() {
+	s.candidates.invalidate()
+	select {
+	case s.work <- true:
+	default:
+	}
+}
+
+// stopTimer stops a timer which may have fired without being received from,
+// so that it can be reset
+func stopTimer(t *time.Timer) {
+	if !t.Stop() {
+		select {
+		case <-t.C:
+		default:
+		}
+	}
 }
 
 // listens for commands from the API. This is intended to be run asynchronously
-// and mainly exists to prevent the API from blocking.
+// and mainly exists to prevent the API from blocking. The service schedules
+// campaigns, sleeping until the next is due or until woken by a change to a
+// campaign, but no longer than Config.PollInterval. Messages are sent
+// separately by the sender, so that a long queue doesn't delay scheduling.
 func service(s *Session) {
-	ticker := time.NewTicker(time.Minute)
+	sent := make(chan struct{})
+	go func() {
+		sender(s)
+		close(sent)
+	}()
+
+	timer := time.NewTimer(0)
+	defer close(s.done)
+	defer func() { <-sent }()
+	defer timer.Stop()
+
+next:
+	select {
+	case <-s.wake:
+		stopTimer(timer)
+	case <-timer.C:
+	case <-s.stop:
+		return
+	}
+
+	// only one session expands due campaigns at a time
+	leader, err := s.acquireLease(s.ctx, schedulerLease, s.config.LeaderLease)
+	if err != nil {
+		s.error("couldn't acquire scheduler lease:", err)
+
+	} else if leader && s.expandDueCampaigns(s.ctx) {
+		s.wakeSender()
+	}
+
+	d := s.config.PollInterval
+	if leader {
+		// campaigns and occurrences sent at local time are expanded early
+		campaignSQL := fmt.Sprintf(`
+SELECT COALESCE(MIN(IF(local_time, scheduled-%[1]d, scheduled)), 0)
+	FROM campaign
+
+WHERE status IN ('scheduled','recurring')
+	AND IF(local_time, scheduled-%[1]d, scheduled)>?`,
+			int64(maxUTCOffset/time.Second))
+
+		d = s.untilNext(s.ctx, campaignSQL)
+	}
+	timer.Reset(d)
+	goto next
+}
+
+// sender sends queued messages until the queue is empty, then sleeps until a
+// deferred message may be retried or it is woken by the scheduler, but no
+// longer than Config.PollInterval.
+func sender(s *Session) {
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+	messageSQL := `
+SELECT COALESCE(MIN(next_attempt), 0)
+	FROM message
+
+WHERE status='pending'
+	AND next_attempt>?`
 
 next:
 	select {
-	case _, ok := <-s.wake:
-		if !ok {
-			ticker.Stop()
-			return
+	case <-s.work:
+		stopTimer(timer)
+	case <-timer.C:
+	case <-s.stop:
+		return
+	}
+
+	s.drain(s.ctx)
+
+	if m, ok := s.mailer.(idleCloser); ok {
+		m.CloseIdleConnections()
+	}
+
+	timer.Reset(s.untilNext(s.ctx, messageSQL))
+	goto next
+}
+
+// untilNext returns the time until the Unix time selected by a query, given
+// the current time as a parameter, capped at Config.PollInterval. The query
+// selects zero if there is no such time.
+func (s *Session) untilNext(ctx context.Context, query string) time.Duration {
+	d := s.config.PollInterval
+	now := time.Now()
+
+	next, err := s.dbmap.WithContext(ctx).SelectInt(query, now.Unix())
+	if err != nil {
+		if ctx.Err() == nil {
+			s.error("couldn't find next scheduled time:", err)
 		}
-	case <-ticker.C:
+		return d
+	}
+	if until := time.Unix(next, 0).Sub(now); next != 0 && until < d {
+		d = until
 	}
+	return d
+}
+
+// expandDueCampaigns adds the messages of all campaigns which are due to the
+// queue, including new occurrences of recurring campaigns. It returns whether
+// any campaigns were expanded. A campaign which can't be expanded doesn't hold
+// up the others, and is retried later (see expansionFailed).
+func (s *Session) expandDueCampaigns(ctx context.Context) (expanded bool) {
+	s.spawnDueRecurrences(ctx)
 
-	for {
-		c, err := getDueCampaign(s)
+	now := time.Now()
+	var skip []interface{}
+	for id, f := range s.expandFailures {
+		if f.next.After(now) {
+			skip = append(skip, id)
+		}
+	}
+
+	for !s.stopping() {
+		c, err := getDueCampaign(ctx, s, skip)
 		if err == ErrNotFound {
 			break
 
@@ -133,27 +450,59 @@ next:
 			break
 		}
 
-		if err = s.sendCampaign(c.ID); err != nil {
-			s.error("couldn't send campaign:", err)
-			break
+		// some messages may have been queued even if expansion failed
+		expanded = true
+		if err = s.sendCampaign(ctx, c.ID); err != nil {
+			if ctx.Err() != nil {
+				break
+			}
+			s.expansionFailed(ctx, c.ID, err)
+			skip = append(skip, c.ID)
+			continue
 		}
+		delete(s.expandFailures, c.ID)
 	}
+	return expanded
+}
 
-	for {
-		m, err := pendingMessage(s)
-		if err == ErrNotFound {
-			break
+// expandFailure records the failed attempts to expand a campaign
+type expandFailure struct {
+	attempts int
+	next     time.Time
+}
 
-		} else if err != nil {
-			s.error("couldn't retrieve pending message:", err)
-			break
-		}
+// expansionFailed records a failed attempt to expand a campaign. As with
+// messages, it is retried after an exponentially increasing delay, and marked
+// failed once it has failed Config.MaxAttempts times.
+func (s *Session) expansionFailed(ctx context.Context, campaignID int64, expandErr error) {
+	f := s.expandFailures[campaignID]
+	if f == nil {
+		f = &expandFailure{}
+		s.expandFailures[campaignID] = f
+	}
+	f.attempts++
 
-		if err = s.sendMessage(m); err != nil {
-			s.error(err)
-			break
+	if f.attempts < s.config.MaxAttempts {
+		backoff := s.config.RetryBackoff << uint(f.attempts-1)
+		if backoff > maxBackoff || backoff <= 0 {
+			backoff = maxBackoff
 		}
-		time.Sleep(time.Second)
+		f.next = time.Now().Add(backoff)
+		s.error(fmt.Sprintf("couldn't send campaign %d, retrying in %v:", campaignID, backoff), expandErr)
+		return
+	}
+
+	delete(s.expandFailures, campaignID)
+	s.error(fmt.Sprintf("couldn't send campaign %d, giving up:", campaignID), expandErr)
+
+	updateSQL := `
+UPDATE campaign
+	SET status='failed'
+
+WHERE status='scheduled'
+	AND id=?`
+
+	if _, err := s.dbmap.WithContext(ctx).Exec(updateSQL, campaignID); err != nil {
+		s.error("couldn't mark campaign failed:", err)
 	}
-	goto next
 }
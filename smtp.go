@@ -0,0 +1,333 @@
+package maillist
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TLS modes for SMTPMailer
+const (
+	SMTPStartTLS = "starttls" // upgrade a plain connection with STARTTLS
+	SMTPTLS      = "tls"      // connect over TLS (usually port 465)
+	SMTPNoTLS    = "none"     // never use TLS
+)
+
+// Authentication mechanisms for SMTPMailer
+const (
+	SMTPAuthPlain   = "plain"
+	SMTPAuthLogin   = "login"
+	SMTPAuthCRAMMD5 = "cram-md5"
+)
+
+// smtpProbeTimeout is how long an idle connection has to answer before it is
+// assumed to be dead
+const smtpProbeTimeout = 10 * time.Second
+
+// SMTPMailer delivers e-mail through an SMTP relay. Connections are kept open
+// between messages and reused, until CloseIdleConnections is called.
+type SMTPMailer struct {
+	Host     string
+	Port     int         // defaults to 465 for SMTPTLS, otherwise 587
+	TLS      string      // one of SMTPStartTLS (default), SMTPTLS or SMTPNoTLS
+	Auth     string      // one of the SMTPAuth constants, or "" for none
+	Username string      // username for Auth
+	Password string      // password for Auth
+	Config   *tls.Config // optional TLS configuration
+
+	// Timeout is how long the server has to respond to the greeting and
+	// each command, unless the context ends sooner. It defaults to a minute.
+	Timeout time.Duration
+
+	mu   sync.Mutex
+	idle []*smtpConn
+}
+
+// smtpConn is a client along with its underlying connection
+type smtpConn struct {
+	*smtp.Client
+	conn *timeoutConn
+}
+
+// timeoutConn is a connection which sets a deadline before each read and
+// write, so that a server which stops responding can't block a send forever.
+// The deadline is no later than that of the context being watched, and has
+// passed once the context is done.
+type timeoutConn struct {
+	net.Conn
+	timeout time.Duration
+
+	mu      sync.Mutex
+	limit   time.Time
+	aborted bool
+}
+
+func (c *timeoutConn) Read(b []byte) (int, error) {
+	c.extend()
+	return c.Conn.Read(b)
+}
+
+func (c *timeoutConn) Write(b []byte) (int, error) {
+	c.extend()
+	return c.Conn.Write(b)
+}
+
+func (c *timeoutConn) extend() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.aborted {
+		return
+	}
+	deadline := time.Now().Add(c.timeout)
+	if !c.limit.IsZero() && c.limit.Before(deadline) {
+		deadline = c.limit
+	}
+	c.Conn.SetDeadline(deadline)
+}
+
+// watch limits reads and writes to the deadline of a context, and interrupts
+// any which are blocked once it is done, until stop is called
+func (c *timeoutConn) watch(ctx context.Context) (stop func()) {
+	c.mu.Lock()
+	c.limit, _ = ctx.Deadline()
+	c.aborted = false
+	c.mu.Unlock()
+
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		select {
+		case <-ctx.Done():
+			c.mu.Lock()
+			c.aborted = true
+			c.Conn.SetDeadline(time.Unix(1, 0))
+			c.mu.Unlock()
+		case <-done:
+		}
+	}()
+
+	return func() {
+		close(done)
+		<-stopped
+		c.mu.Lock()
+		c.limit = time.Time{}
+		c.mu.Unlock()
+	}
+}
+
+// Send sends a single e-mail, reusing an idle connection if there is one. The
+// connection is closed if the context is done before the e-mail is sent.
+func (m *SMTPMailer) Send(ctx context.Context, e *Email) error {
+	c, err := m.conn(ctx)
+	if err != nil {
+		return err
+	}
+
+	stop := c.conn.watch(ctx)
+	err = deliverSMTP(c.Client, e)
+	stop()
+
+	if err != nil {
+		c.Close()
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return err
+	}
+
+	m.mu.Lock()
+	m.idle = append(m.idle, c)
+	m.mu.Unlock()
+	return nil
+}
+
+// CloseIdleConnections closes any connections not currently in use
+func (m *SMTPMailer) CloseIdleConnections() {
+	m.mu.Lock()
+	idle := m.idle
+	m.idle = nil
+	m.mu.Unlock()
+
+	for _, c := range idle {
+		c.Quit()
+	}
+}
+
+// conn returns a healthy idle connection, or dials a new one
+func (m *SMTPMailer) conn(ctx context.Context) (*smtpConn, error) {
+	for {
+		m.mu.Lock()
+		if len(m.idle) == 0 {
+			m.mu.Unlock()
+			return m.dial(ctx)
+		}
+		c := m.idle[len(m.idle)-1]
+		m.idle = m.idle[:len(m.idle)-1]
+		m.mu.Unlock()
+
+		// the server may have dropped the connection while it was idle, and
+		// a half-open connection would otherwise never answer
+		probe, cancel := context.WithTimeout(ctx, smtpProbeTimeout)
+		stop := c.conn.watch(probe)
+		err := c.Reset()
+		stop()
+		cancel()
+		if err == nil {
+			return c, nil
+		}
+		c.Close()
+	}
+}
+
+func (m *SMTPMailer) dial(ctx context.Context) (*smtpConn, error) {
+	port := m.Port
+	if port == 0 && m.TLS == SMTPTLS {
+		port = 465
+	} else if port == 0 {
+		port = 587
+	}
+	addr := net.JoinHostPort(m.Host, strconv.Itoa(port))
+
+	config := m.Config
+	if config == nil {
+		config = &tls.Config{ServerName: m.Host}
+	}
+
+	switch m.TLS {
+	case SMTPTLS, SMTPStartTLS, SMTPNoTLS, "":
+	default:
+		return nil, fmt.Errorf("unknown SMTP TLS mode '%s'", m.TLS)
+	}
+
+	dialer := net.Dialer{Timeout: 30 * time.Second}
+	raw, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	// the handshake and greeting must also complete before the context ends
+	timeout := m.Timeout
+	if timeout == 0 {
+		timeout = time.Minute
+	}
+	conn := &timeoutConn{Conn: raw, timeout: timeout}
+	stop := conn.watch(ctx)
+	defer stop()
+
+	var c *smtp.Client
+	if m.TLS == SMTPTLS {
+		tlsConn := tls.Client(conn, config)
+		if err = tlsConn.Handshake(); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		c, err = smtp.NewClient(tlsConn, m.Host)
+	} else {
+		c, err = smtp.NewClient(conn, m.Host)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	if m.TLS == SMTPStartTLS || m.TLS == "" {
+		if ok, _ := c.Extension("STARTTLS"); !ok {
+			c.Close()
+			return nil, fmt.Errorf("SMTP server %s does not support STARTTLS", addr)
+		}
+		if err = c.StartTLS(config); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+
+	if m.Auth != "" {
+		auth, err := m.auth()
+		if err == nil {
+			err = c.Auth(auth)
+		}
+		if err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	return &smtpConn{c, conn}, nil
+}
+
+func (m *SMTPMailer) auth() (smtp.Auth, error) {
+	switch strings.ToLower(m.Auth) {
+	case SMTPAuthPlain:
+		return smtp.PlainAuth("", m.Username, m.Password, m.Host), nil
+	case SMTPAuthLogin:
+		return &loginAuth{m.Username, m.Password, m.Host}, nil
+	case SMTPAuthCRAMMD5:
+		return smtp.CRAMMD5Auth(m.Username, m.Password), nil
+	}
+	return nil, fmt.Errorf("unknown SMTP auth mechanism '%s'", m.Auth)
+}
+
+// deliverSMTP sends a single e-mail over an established connection
+func deliverSMTP(c *smtp.Client, e *Email) error {
+	err := c.Mail(e.From.Address)
+	if err == nil {
+		err = c.Rcpt(e.To.Address)
+	}
+	if err == nil {
+		var w io.WriteCloser
+		if w, err = c.Data(); err == nil {
+			if _, err = w.Write(formatEmail(e, time.Now())); err != nil {
+				w.Close()
+			} else {
+				err = w.Close()
+			}
+		}
+	}
+
+	// 5xx replies are permanent failures, 4xx replies may succeed later
+	if tpErr, ok := err.(*textproto.Error); ok && tpErr.Code >= 500 {
+		return &PermanentError{err}
+	}
+	return err
+}
+
+// loginAuth implements the non-standard but widely used LOGIN mechanism,
+// which net/smtp does not provide
+type loginAuth struct {
+	username, password, host string
+}
+
+func (a *loginAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	// as with smtp.PlainAuth, credentials are only sent over an encrypted
+	// connection or to localhost
+	if !server.TLS && a.host != "localhost" && a.host != "127.0.0.1" && a.host != "::1" {
+		return "", nil, errors.New("unencrypted connection")
+	}
+	if server.Name != a.host {
+		return "", nil, errors.New("wrong host name")
+	}
+	return "LOGIN", nil, nil
+}
+
+func (a *loginAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if !more {
+		return nil, nil
+	}
+	prompt := strings.ToLower(string(fromServer))
+	switch {
+	case strings.HasPrefix(prompt, "user"):
+		return []byte(a.username), nil
+	case strings.HasPrefix(prompt, "pass"):
+		return []byte(a.password), nil
+	}
+	return nil, fmt.Errorf("unexpected LOGIN challenge '%s'", fromServer)
+}
@@ -0,0 +1,342 @@
+package maillist_test
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Attendly/maillist"
+)
+
+// smtpServer is a minimal in-process SMTP server which records what it
+// receives
+type smtpServer struct {
+	l     net.Listener
+	certs []tls.Certificate
+
+	mu       sync.Mutex
+	conns    int
+	auths    []string
+	messages []string
+}
+
+func newSMTPServer(t *testing.T, certs []tls.Certificate) *smtpServer {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("could not listen: %v", err)
+	}
+	s := &smtpServer{l: l, certs: certs}
+	go s.serve()
+	return s
+}
+
+func (s *smtpServer) port() int {
+	return s.l.Addr().(*net.TCPAddr).Port
+}
+
+// received returns the number of connections made, and the auth mechanisms
+// and messages received so far
+func (s *smtpServer) received() (conns int, auths, messages []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.conns, s.auths, s.messages
+}
+
+func (s *smtpServer) serve() {
+	for {
+		conn, err := s.l.Accept()
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		s.conns++
+		s.mu.Unlock()
+		go s.handle(conn)
+	}
+}
+
+func (s *smtpServer) handle(conn net.Conn) {
+	defer conn.Close()
+	tp := textproto.NewConn(conn)
+	tp.PrintfLine("220 localhost ESMTP")
+	secure := false
+
+	for {
+		line, err := tp.ReadLine()
+		if err != nil {
+			return
+		}
+		verb, arg := line, ""
+		if i := strings.Index(line, " "); i >= 0 {
+			verb, arg = line[:i], line[i+1:]
+		}
+
+		switch strings.ToUpper(verb) {
+		case "EHLO", "HELO":
+			tp.PrintfLine("250-localhost")
+			if s.certs != nil && !secure {
+				tp.PrintfLine("250-STARTTLS")
+			}
+			tp.PrintfLine("250 AUTH PLAIN LOGIN CRAM-MD5")
+
+		case "STARTTLS":
+			tp.PrintfLine("220 Ready to start TLS")
+			tc := tls.Server(conn, &tls.Config{Certificates: s.certs})
+			if err := tc.Handshake(); err != nil {
+				return
+			}
+			conn, tp, secure = tc, textproto.NewConn(tc), true
+
+		case "AUTH":
+			mech := strings.ToUpper(strings.Fields(arg)[0])
+			switch mech {
+			case "PLAIN":
+				if len(strings.Fields(arg)) == 1 {
+					tp.PrintfLine("334 ")
+					tp.ReadLine()
+				}
+			case "LOGIN":
+				tp.PrintfLine("334 %s", base64.StdEncoding.EncodeToString([]byte("Username:")))
+				tp.ReadLine()
+				tp.PrintfLine("334 %s", base64.StdEncoding.EncodeToString([]byte("Password:")))
+				tp.ReadLine()
+			case "CRAM-MD5":
+				tp.PrintfLine("334 %s", base64.StdEncoding.EncodeToString([]byte("<1.2@localhost>")))
+				tp.ReadLine()
+			}
+			s.mu.Lock()
+			s.auths = append(s.auths, mech)
+			s.mu.Unlock()
+			tp.PrintfLine("235 Authentication successful")
+
+		case "MAIL", "RCPT", "RSET", "NOOP":
+			tp.PrintfLine("250 OK")
+
+		case "DATA":
+			tp.PrintfLine("354 Go ahead")
+			lines, err := tp.ReadDotLines()
+			if err != nil {
+				return
+			}
+			s.mu.Lock()
+			s.messages = append(s.messages, strings.Join(lines, "\n"))
+			s.mu.Unlock()
+			tp.PrintfLine("250 OK")
+
+		case "QUIT":
+			tp.PrintfLine("221 Bye")
+			return
+
+		default:
+			tp.PrintfLine("502 Command not implemented")
+		}
+	}
+}
+
+func TestSMTPMailer(t *testing.T) {
+	server := newSMTPServer(t, nil)
+	defer server.l.Close()
+
+	m := maillist.SMTPMailer{
+		Host:     "127.0.0.1",
+		Port:     server.port(),
+		TLS:      maillist.SMTPNoTLS,
+		Auth:     maillist.SMTPAuthPlain,
+		Username: "user",
+		Password: "pass",
+	}
+
+	e := maillist.Email{
+		From:    maillist.Address{Name: "Joe Bloggs", Address: "joe@example.com"},
+		To:      maillist.Address{Name: "Tommy Barker", Address: "tom@example.com"},
+		Subject: "Awesome Event 2016",
+		Body:    "Hi Tommy Barker",
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := m.Send(context.Background(), &e); err != nil {
+			t.Fatalf("could not send: %v", err)
+		}
+	}
+	conns, _, messages := server.received()
+	if conns != 1 {
+		t.Errorf("got %d connections, want connection to be reused", conns)
+	}
+	if len(messages) != 2 {
+		t.Fatalf("got %d messages, want 2", len(messages))
+	}
+	for _, want := range []string{
+		"Subject: Awesome Event 2016",
+		`To: "Tommy Barker" <tom@example.com>`,
+		"Content-Type: text/plain; charset=utf-8",
+		"Hi Tommy Barker",
+	} {
+		if !strings.Contains(messages[0], want) {
+			t.Errorf("message does not contain '%s':\n%s", want, messages[0])
+		}
+	}
+
+	m.CloseIdleConnections()
+	if err := m.Send(context.Background(), &e); err != nil {
+		t.Fatalf("could not send: %v", err)
+	}
+	if conns, _, _ = server.received(); conns != 2 {
+		t.Errorf("got %d connections, want a new connection after close", conns)
+	}
+}
+
+func TestSMTPMailerAuth(t *testing.T) {
+	server := newSMTPServer(t, nil)
+	defer server.l.Close()
+
+	e := maillist.Email{
+		From:    maillist.Address{Address: "joe@example.com"},
+		To:      maillist.Address{Address: "tom@example.com"},
+		Subject: "Auth",
+		Body:    "Hi",
+	}
+
+	auths := []string{maillist.SMTPAuthPlain, maillist.SMTPAuthLogin, maillist.SMTPAuthCRAMMD5}
+	for _, auth := range auths {
+		m := maillist.SMTPMailer{
+			Host:     "127.0.0.1",
+			Port:     server.port(),
+			TLS:      maillist.SMTPNoTLS,
+			Auth:     auth,
+			Username: "user",
+			Password: "pass",
+		}
+		if err := m.Send(context.Background(), &e); err != nil {
+			t.Errorf("could not send with %s auth: %v", auth, err)
+		}
+		m.CloseIdleConnections()
+	}
+
+	want := []string{"PLAIN", "LOGIN", "CRAM-MD5"}
+	if _, got, _ := server.received(); strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("got auth mechanisms %v, want %v", got, want)
+	}
+}
+
+func TestSMTPMailerStartTLS(t *testing.T) {
+	// borrow a certificate for 127.0.0.1 from httptest
+	ts := httptest.NewTLSServer(http.NotFoundHandler())
+	certs := ts.TLS.Certificates
+	pool := x509.NewCertPool()
+	pool.AddCert(ts.Certificate())
+	ts.Close()
+
+	server := newSMTPServer(t, certs)
+	defer server.l.Close()
+
+	m := maillist.SMTPMailer{
+		Host:     "127.0.0.1",
+		Port:     server.port(),
+		Auth:     maillist.SMTPAuthPlain,
+		Username: "user",
+		Password: "pass",
+		Config:   &tls.Config{RootCAs: pool, ServerName: "127.0.0.1"},
+	}
+	defer m.CloseIdleConnections()
+
+	e := maillist.Email{
+		From:    maillist.Address{Address: "joe@example.com"},
+		To:      maillist.Address{Address: "tom@example.com"},
+		Subject: "STARTTLS",
+		Body:    "Hi",
+	}
+	if err := m.Send(context.Background(), &e); err != nil {
+		t.Fatalf("could not send: %v", err)
+	}
+	if _, _, messages := server.received(); len(messages) != 1 {
+		t.Fatalf("got %d messages, want 1", len(messages))
+	}
+}
+
+func TestSMTPMailerContext(t *testing.T) {
+	// a server which accepts connections but never greets the client
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer c.Close()
+		}
+	}()
+
+	m := maillist.SMTPMailer{
+		Host: "127.0.0.1",
+		Port: l.Addr().(*net.TCPAddr).Port,
+		TLS:  maillist.SMTPNoTLS,
+	}
+	e := maillist.Email{
+		From: maillist.Address{Address: "joe@example.com"},
+		To:   maillist.Address{Address: "tom@example.com"},
+		Body: "Hi",
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	if err := m.Send(ctx, &e); err == nil {
+		t.Fatal("send succeeded, want deadline to be exceeded")
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("send took %v, want it to be aborted at the deadline", d)
+	}
+}
+
+func TestSMTPMailerTimeout(t *testing.T) {
+	// a server which greets the client, then stops responding
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer c.Close()
+			textproto.NewConn(c).PrintfLine("220 localhost ESMTP")
+		}
+	}()
+
+	m := maillist.SMTPMailer{
+		Host:    "127.0.0.1",
+		Port:    l.Addr().(*net.TCPAddr).Port,
+		TLS:     maillist.SMTPNoTLS,
+		Timeout: 100 * time.Millisecond,
+	}
+	e := maillist.Email{
+		From: maillist.Address{Address: "joe@example.com"},
+		To:   maillist.Address{Address: "tom@example.com"},
+		Body: "Hi",
+	}
+
+	start := time.Now()
+	if err := m.Send(context.Background(), &e); err == nil {
+		t.Fatal("send succeeded, want it to time out")
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("send took %v, want it to time out after 100ms", d)
+	}
+}
@@ -1,16 +1,19 @@
 package maillist
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"regexp"
+	"sync"
 	"time"
 )
 
 var (
+	spamReportsMu      sync.Mutex
 	spamReportsUpdated time.Time
 	convTimeToISO      *regexp.Regexp
 	spamReports        map[string]bool
@@ -23,7 +26,7 @@ func init() {
 
 // updateSpamReports polls the SendGrid servers for a list of spam reports and
 // populates the spamReports variable as appropriate.
-func updateSpamReports(s *Session) error {
+func updateSpamReports(ctx context.Context, s *Session) error {
 	if s.config.SendGridUsername == "" {
 		return errors.New("SendGrid username not set")
 	}
@@ -34,11 +37,17 @@ func updateSpamReports(s *Session) error {
 		`https://api.sendgrid.com/api/spamreports.get.json?api_user=%s&api_key=%s&date=1`,
 		s.config.SendGridUsername, s.config.SendGridPassword)
 
-	resp, err := http.Get(url)
+	req, err := http.NewRequest("GET", url, nil)
 	if err != nil {
 		return err
 	}
 
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
 	if resp.StatusCode != 200 {
 		return fmt.Errorf("http error %s: %s", resp.Status, resp.Body)
 	}
@@ -62,15 +71,28 @@ func updateSpamReports(s *Session) error {
 	for _, report := range spamReportsList {
 		spamReports[report.Email] = true
 	}
+	spamReportsUpdated = time.Now()
 
 	return nil
 }
 
 // HasReportedSpam checks whether an email address has made a spam report
-// against us. Mail should not be sent to such an address.
+// against us. Mail should not be sent to such an address. Spam reports are
+// only available when SendGrid credentials are configured.
 func (s *Session) HasReportedSpam(email string) (bool, error) {
+	return s.HasReportedSpamContext(context.Background(), email)
+}
+
+// HasReportedSpamContext is like HasReportedSpam but with a context
+func (s *Session) HasReportedSpamContext(ctx context.Context, email string) (bool, error) {
+	if _, ok := s.mailer.(*SendGridMailer); !ok && s.config.SendGridUsername == "" {
+		return false, nil
+	}
+	spamReportsMu.Lock()
+	defer spamReportsMu.Unlock()
+
 	if spamReports == nil || time.Now().Sub(spamReportsUpdated) > 6*time.Hour {
-		err := updateSpamReports(s)
+		err := updateSpamReports(ctx, s)
 		if err != nil && !s.config.JustPrint {
 			return false, err
 		}
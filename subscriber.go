@@ -1,6 +1,7 @@
 package maillist
 
 import (
+	"context"
 	"crypto/rand"
 	"crypto/sha256"
 	"database/sql"
@@ -13,7 +14,13 @@ import (
 
 // Subscriber stores a single email address and some associated parameters.
 // Each subscriber must have an associated account, and a given email address
-// will have one subscriber for each account
+// will have one subscriber for each account. Timezone is the IANA name of the
+// subscriber's timezone, or empty to use the account's.
+//
+// Attributes are custom details of the subscriber, such as their company or
+// ticket type, which campaigns can use as e.g. {{.Attr.company}}. They are
+// saved by InsertSubscriber, but not retrieved with the subscriber; see
+// GetSubscriberAttributes and SetSubscriberAttributes.
 type Subscriber struct {
 	ID         int64  `db:"id"`
 	AccountID  int64  `db:"account_id" validate:"required"`
@@ -21,11 +28,19 @@ type Subscriber struct {
 	LastName   string `db:"last_name" validate:"required"`
 	Email      string `db:"email" validate:"required,email"`
 	Status     string `db:"status" validate:"eq=active|eq=deleted|eq=unsubscribed"`
+	Timezone   string `db:"timezone"`
 	CreateTime int64  `db:"create_time" validate:"required"`
+
+	Attributes map[string]string `db:"-"`
 }
 
 // GetSubscribers retrieves all the subscribers in a mailing list
 func (s *Session) GetSubscribers(listID int64) ([]*Subscriber, error) {
+	return s.GetSubscribersContext(context.Background(), listID)
+}
+
+// GetSubscribersContext is like GetSubscribers but with a context
+func (s *Session) GetSubscribersContext(ctx context.Context, listID int64) ([]*Subscriber, error) {
 	var subs []*Subscriber
 
 	selectSQL := fmt.Sprintf(`
@@ -44,7 +59,7 @@ WHERE
 	AND list_id=?`,
 		s.selectString(&Subscriber{}))
 
-	if _, err := s.dbmap.Select(&subs, selectSQL, listID); err != nil {
+	if _, err := s.dbmap.WithContext(ctx).Select(&subs, selectSQL, listID); err != nil {
 		return nil, err
 
 	} else if len(subs) == 0 {
@@ -56,11 +71,16 @@ WHERE
 // GetSubscriber retrieves a subscriber with a given ID. Returns nil,nil if no
 // such subscriber exists
 func (s *Session) GetSubscriber(subscriberID int64) (*Subscriber, error) {
+	return s.GetSubscriberContext(context.Background(), subscriberID)
+}
+
+// GetSubscriberContext is like GetSubscriber but with a context
+func (s *Session) GetSubscriberContext(ctx context.Context, subscriberID int64) (*Subscriber, error) {
 	var sub Subscriber
 	query := fmt.Sprintf("select %s from subscriber where id=? and status!='deleted'",
 		s.selectString(&sub))
 
-	err := s.dbmap.SelectOne(&sub, query, subscriberID)
+	err := s.dbmap.WithContext(ctx).SelectOne(&sub, query, subscriberID)
 	if err == sql.ErrNoRows {
 		return nil, ErrNotFound
 
@@ -73,6 +93,11 @@ func (s *Session) GetSubscriber(subscriberID int64) (*Subscriber, error) {
 // GetSubscriberByEmail retrieves a subscriber with a given email address.
 // Returns nil,nil if no such subscriber exists
 func (s *Session) GetSubscriberByEmail(email string, accountID int64) (*Subscriber, error) {
+	return s.GetSubscriberByEmailContext(context.Background(), email, accountID)
+}
+
+// GetSubscriberByEmailContext is like GetSubscriberByEmail but with a context
+func (s *Session) GetSubscriberByEmailContext(ctx context.Context, email string, accountID int64) (*Subscriber, error) {
 
 	selectSQL := fmt.Sprintf(`
 SELECT
@@ -87,7 +112,7 @@ WHERE
 		s.selectString(Subscriber{}))
 
 	var sub Subscriber
-	err := s.dbmap.SelectOne(&sub, selectSQL, email, accountID)
+	err := s.dbmap.WithContext(ctx).SelectOne(&sub, selectSQL, email, accountID)
 
 	if err == sql.ErrNoRows {
 		return nil, ErrNotFound
@@ -100,20 +125,44 @@ WHERE
 
 // InsertSubscriber into the db
 func (s *Session) InsertSubscriber(sub *Subscriber) error {
+	return s.InsertSubscriberContext(context.Background(), sub)
+}
+
+// InsertSubscriberContext is like InsertSubscriber but with a context
+func (s *Session) InsertSubscriberContext(ctx context.Context, sub *Subscriber) error {
 	if sub.Status == "" {
 		sub.Status = statusActive
 	}
-	return s.insert(sub)
+	if err := checkTimezone(sub.Timezone); err != nil {
+		return err
+	}
+	if err := checkAttributes(sub.Attributes); err != nil {
+		return err
+	}
+	if err := s.insert(ctx, sub); err != nil {
+		return err
+	}
+	return s.SetSubscriberAttributesContext(ctx, sub.ID, sub.Attributes)
 }
 
 // DeleteSubscriber from the db
 func (s *Session) DeleteSubscriber(id int64) error {
-	return s.delete(Subscriber{}, id)
+	return s.DeleteSubscriberContext(context.Background(), id)
+}
+
+// DeleteSubscriberContext is like DeleteSubscriber but with a context
+func (s *Session) DeleteSubscriberContext(ctx context.Context, id int64) error {
+	return s.delete(ctx, Subscriber{}, id)
 }
 
 // Unsubscribe marks a subscriber as not wanting to recieve any more marketting
 // emails
 func (s *Session) Unsubscribe(sub *Subscriber) error {
+	return s.UnsubscribeContext(context.Background(), sub)
+}
+
+// UnsubscribeContext is like Unsubscribe but with a context
+func (s *Session) UnsubscribeContext(ctx context.Context, sub *Subscriber) error {
 
 	updateSQL := `
 UPDATE
@@ -125,14 +174,14 @@ SET
 WHERE
 	id=?`
 
-	_, err := s.dbmap.Exec(updateSQL, sub.ID)
+	_, err := s.dbmap.WithContext(ctx).Exec(updateSQL, sub.ID)
 
 	return err
 }
 
 // getUnsubscribeSalt gets a random string unique to this installation to salt
 // unsubscribe tokens with as part of the hashing process.
-func getUnsubscribeSalt(s *Session) (string, error) {
+func getUnsubscribeSalt(ctx context.Context, s *Session) (string, error) {
 
 	selectSQL := `
 SELECT
@@ -143,7 +192,7 @@ FROM
 WHERE
 	name='unsubscribe-salt'`
 
-	salt, err := s.dbmap.SelectStr(selectSQL)
+	salt, err := s.dbmap.WithContext(ctx).SelectStr(selectSQL)
 	if err != nil {
 		return "", err
 	}
@@ -165,7 +214,7 @@ INSERT INTO
 VALUES
 	('unsubscribe-salt', ?)`
 
-	_, err = s.dbmap.Exec(insertSQL, salt)
+	_, err = s.dbmap.WithContext(ctx).Exec(insertSQL, salt)
 	if err != nil {
 		return "", err
 	}
@@ -176,7 +225,12 @@ VALUES
 // subscriber. Using such a token means that only the recepiant of an email can
 // unsubscribe from that mailing list.
 func (s *Session) UnsubscribeToken(sub *Subscriber) (string, error) {
-	salt, err := getUnsubscribeSalt(s)
+	return s.UnsubscribeTokenContext(context.Background(), sub)
+}
+
+// UnsubscribeTokenContext is like UnsubscribeToken but with a context
+func (s *Session) UnsubscribeTokenContext(ctx context.Context, sub *Subscriber) (string, error) {
+	salt, err := getUnsubscribeSalt(ctx, s)
 	if err != nil {
 		return "", err
 	}
@@ -190,6 +244,11 @@ func (s *Session) UnsubscribeToken(sub *Subscriber) (string, error) {
 // GetSubscriberByToken retrieves the subscriber associated with a token.
 // Returns an error if the token doesn't match any in the database
 func (s *Session) GetSubscriberByToken(token string) (*Subscriber, error) {
+	return s.GetSubscriberByTokenContext(context.Background(), token)
+}
+
+// GetSubscriberByTokenContext is like GetSubscriberByToken but with a context
+func (s *Session) GetSubscriberByTokenContext(ctx context.Context, token string) (*Subscriber, error) {
 	ss := strings.Split(token, "~")
 	if len(ss) != 2 {
 		return nil, errors.New("Unsubscribe token could not be parsed")
@@ -200,7 +259,7 @@ func (s *Session) GetSubscriberByToken(token string) (*Subscriber, error) {
 		return nil, fmt.Errorf("unsubscribe token could not be parsed: %v", err)
 	}
 
-	sub, err := s.GetSubscriber(id)
+	sub, err := s.GetSubscriberContext(ctx, id)
 	if err != nil {
 		return nil, err
 
@@ -209,7 +268,7 @@ func (s *Session) GetSubscriberByToken(token string) (*Subscriber, error) {
 		return nil, err
 	}
 
-	wantedToken, err := s.UnsubscribeToken(sub)
+	wantedToken, err := s.UnsubscribeTokenContext(ctx, sub)
 	if err != nil {
 		return nil, err
 	}
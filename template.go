@@ -0,0 +1,339 @@
+package maillist
+
+import (
+	"bytes"
+	"fmt"
+	htmltemplate "html/template"
+	"io"
+	"io/ioutil"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/template"
+	"text/template/parse"
+)
+
+// templateData holds the fields available to campaign templates. Attr holds
+// the subscriber's attributes, and is empty for any they don't have.
+type templateData struct {
+	FirstName, LastName, UnsubscribeURL string
+
+	Attr map[string]string
+}
+
+// templateFuncs are the functions available to both plain text and HTML
+// campaign templates
+var templateFuncs = map[string]interface{}{
+	"upper": strings.ToUpper,
+	"lower": strings.ToLower,
+	"title": strings.Title,
+	"trim":  strings.TrimSpace,
+
+	// default returns value, or def if value is empty, e.g.
+	// {{.FirstName | default "there"}}
+	"default": func(def, value string) string {
+		if value == "" {
+			return def
+		}
+		return value
+	},
+}
+
+// missingKey makes attributes a subscriber doesn't have empty, so that e.g.
+// {{.Attr.company | default "your company"}} works
+const missingKey = "missingkey=zero"
+
+// campaignTemplates are the parsed templates of a campaign. The subject,
+// preheader and plain text body are rendered with text/template, and the HTML
+// body with html/template, so that only the HTML is escaped. Each may be nil
+// if the campaign doesn't have it.
+type campaignTemplates struct {
+	subject, preheader, text *template.Template
+	html                     *htmltemplate.Template
+}
+
+// parseTemplates parses the templates of a campaign
+func parseTemplates(campaign *Campaign) (*campaignTemplates, error) {
+	var t campaignTemplates
+	var err error
+
+	for _, f := range []struct {
+		name, value string
+		t           **template.Template
+	}{
+		{"subject", campaign.Subject, &t.subject},
+		{"preheader", campaign.Preheader, &t.preheader},
+		{"body", campaign.Body, &t.text},
+	} {
+		if f.value == "" {
+			continue
+		}
+		if *f.t, err = template.New(f.name).Funcs(templateFuncs).Option(missingKey).Parse(f.value); err != nil {
+			return nil, err
+		}
+	}
+
+	if campaign.HTMLBody != "" {
+		t.html, err = htmltemplate.New("html_body").Funcs(templateFuncs).Option(missingKey).Parse(campaign.HTMLBody)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &t, nil
+}
+
+// renderedCampaign is a campaign rendered for a single subscriber
+type renderedCampaign struct {
+	subject, text, html string
+}
+
+// renderCampaign executes a campaign's templates. If the campaign only has
+// one body, the other is generated from it, and the preheader is added to the
+// start of the HTML. Templates are cached, other than those of transactional
+// e-mails which are only rendered once.
+func renderCampaign(s *Session, campaign *Campaign, data *templateData) (*renderedCampaign, error) {
+	s.templatesMu.Lock()
+	t := s.templates[campaign.ID]
+	if t == nil {
+		var err error
+		if t, err = parseTemplates(campaign); err != nil {
+			s.templatesMu.Unlock()
+			return nil, err
+		}
+		if campaign.Status != "transactional" {
+			s.templates[campaign.ID] = t
+		}
+	}
+	s.templatesMu.Unlock()
+
+	var r renderedCampaign
+	var preheader string
+	var buf bytes.Buffer
+
+	for _, f := range []struct {
+		t   *template.Template
+		out *string
+	}{
+		{t.subject, &r.subject},
+		{t.preheader, &preheader},
+		{t.text, &r.text},
+	} {
+		if f.t == nil {
+			continue
+		}
+		buf.Reset()
+		if err := f.t.Execute(&buf, data); err != nil {
+			return nil, err
+		}
+		*f.out = buf.String()
+	}
+
+	if t.html != nil {
+		buf.Reset()
+		if err := t.html.Execute(&buf, data); err != nil {
+			return nil, err
+		}
+		r.html = buf.String()
+	}
+
+	// a subject is a single line
+	r.subject = strings.Join(strings.Fields(r.subject), " ")
+
+	if t.html == nil {
+		r.html = textToHTML(r.text)
+	}
+	if t.text == nil {
+		r.text = htmlToText(r.html)
+	}
+	r.html = addPreheader(r.html, strings.TrimSpace(preheader))
+	return &r, nil
+}
+
+// addPreheader adds hidden preview text to the start of an HTML body, which
+// many mail clients show after the subject
+func addPreheader(html, preheader string) string {
+	if preheader == "" {
+		return html
+	}
+	div := `<div style="display:none;max-height:0;overflow:hidden;">` +
+		htmltemplate.HTMLEscapeString(preheader) + "</div>\n"
+
+	lower := strings.ToLower(html)
+	if i := strings.Index(lower, "<body"); i >= 0 {
+		if end := strings.Index(lower[i:], ">"); end >= 0 {
+			i += end + 1
+			return html[:i] + div + html[i:]
+		}
+	}
+	return div + html
+}
+
+// TemplateError is returned when a campaign's subject, preheader or body is
+// not a valid template. Field is the template's name ("subject", "preheader",
+// "body" or "html_body"), and Line and Column locate the error within it where
+// known, as reported by text/template; Column is 0 for most syntax errors.
+// UnknownFields lists the fields used by the template which don't exist.
+type TemplateError struct {
+	Field         string
+	Line, Column  int
+	UnknownFields []string
+	Err           error
+}
+
+func (e *TemplateError) Error() string {
+	return e.Err.Error()
+}
+
+// templateErrorLocation matches the location at the start of errors from
+// text/template and html/template, e.g. "template: body:3:14: ..."
+var templateErrorLocation = regexp.MustCompile(`^(?:html/)?template: ?([a-z_]+):(\d+):(?:(\d+):)?`)
+
+// newTemplateError describes an error parsing or executing a template
+func newTemplateError(err error) *TemplateError {
+	e := TemplateError{Err: err}
+	if m := templateErrorLocation.FindStringSubmatch(err.Error()); m != nil {
+		e.Field = m[1]
+		e.Line, _ = strconv.Atoi(m[2])
+		e.Column, _ = strconv.Atoi(m[3])
+	}
+	return &e
+}
+
+// checkTemplates parses a campaign's templates and renders them for a sample
+// subscriber, so that a campaign which can't be sent is rejected before it
+// is queued. It returns a *TemplateError if any template is invalid.
+func (s *Session) checkTemplates(c *Campaign) error {
+	t, err := parseTemplates(c)
+	if err != nil {
+		return newTemplateError(err)
+	}
+
+	for _, f := range []struct {
+		name string
+		tree *parse.Tree
+	}{
+		{"subject", treeOf(t.subject)},
+		{"preheader", treeOf(t.preheader)},
+		{"body", treeOf(t.text)},
+		{"html_body", htmlTreeOf(t.html)},
+	} {
+		if f.tree == nil {
+			continue
+		}
+		if e := unknownFields(f.name, f.tree); e != nil {
+			return e
+		}
+	}
+
+	sample := &templateData{"Sample", "Subscriber", s.config.UnsubscribeURL + "/sample", map[string]string{}}
+	for _, f := range []interface {
+		Execute(io.Writer, interface{}) error
+	}{t.subject, t.preheader, t.text, t.html} {
+		if reflect.ValueOf(f).IsNil() {
+			continue
+		}
+		if err = f.Execute(ioutil.Discard, sample); err != nil {
+			return newTemplateError(err)
+		}
+	}
+	return nil
+}
+
+func treeOf(t *template.Template) *parse.Tree {
+	if t == nil {
+		return nil
+	}
+	return t.Tree
+}
+
+func htmlTreeOf(t *htmltemplate.Template) *parse.Tree {
+	if t == nil {
+		return nil
+	}
+	return t.Tree
+}
+
+// unknownFields returns an error listing the fields used by a template which
+// templateData doesn't have, located at the first of them
+func unknownFields(name string, tree *parse.Tree) *TemplateError {
+	known := make(map[string]bool)
+	typ := reflect.TypeOf(templateData{})
+	for i := 0; i < typ.NumField(); i++ {
+		known[typ.Field(i).Name] = true
+	}
+
+	var e *TemplateError
+	seen := make(map[string]bool)
+	check := func(n parse.Node, field string) {
+		if known[field] || seen[field] {
+			return
+		}
+		seen[field] = true
+		if e == nil {
+			e = &TemplateError{Field: name}
+			location, _ := tree.ErrorContext(n)
+			if parts := strings.Split(location, ":"); len(parts) == 3 {
+				e.Line, _ = strconv.Atoi(parts[1])
+				e.Column, _ = strconv.Atoi(parts[2])
+			}
+		}
+		e.UnknownFields = append(e.UnknownFields, field)
+	}
+
+	// fields are only checked where dot is the subscriber's data, and not
+	// within the body of a range or with
+	var walk func(node parse.Node, root bool)
+	walk = func(node parse.Node, root bool) {
+		switch n := node.(type) {
+		case *parse.ListNode:
+			if n != nil {
+				for _, c := range n.Nodes {
+					walk(c, root)
+				}
+			}
+		case *parse.ActionNode:
+			walk(n.Pipe, root)
+		case *parse.PipeNode:
+			if n != nil {
+				for _, c := range n.Cmds {
+					walk(c, root)
+				}
+			}
+		case *parse.CommandNode:
+			for _, a := range n.Args {
+				walk(a, root)
+			}
+		case *parse.ChainNode:
+			walk(n.Node, root)
+		case *parse.IfNode:
+			walk(n.Pipe, root)
+			walk(n.List, root)
+			walk(n.ElseList, root)
+		case *parse.RangeNode:
+			walk(n.Pipe, root)
+			walk(n.List, false)
+			walk(n.ElseList, root)
+		case *parse.WithNode:
+			walk(n.Pipe, root)
+			walk(n.List, false)
+			walk(n.ElseList, root)
+		case *parse.TemplateNode:
+			walk(n.Pipe, root)
+		case *parse.FieldNode:
+			if root {
+				check(n, n.Ident[0])
+			}
+		case *parse.VariableNode:
+			if n.Ident[0] == "$" && len(n.Ident) > 1 {
+				check(n, n.Ident[1])
+			}
+		}
+	}
+	walk(tree.Root, true)
+
+	if e != nil {
+		e.Err = fmt.Errorf("template: %s:%d:%d: unknown field(s) %s", name, e.Line, e.Column, strings.Join(e.UnknownFields, ", "))
+	}
+	return e
+}
@@ -0,0 +1,66 @@
+package maillist
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// maxUTCOffset is the furthest ahead of UTC that any timezone is (UTC+14), and
+// so how early a campaign sent at local time must be expanded
+const maxUTCOffset = 14 * time.Hour
+
+var (
+	locationsMu sync.Mutex
+	locations   = make(map[string]*time.Location)
+)
+
+// loadLocation is like time.LoadLocation, but caches locations as campaigns
+// look up the same few for every subscriber
+func loadLocation(name string) (*time.Location, error) {
+	locationsMu.Lock()
+	defer locationsMu.Unlock()
+
+	if loc, ok := locations[name]; ok {
+		return loc, nil
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return nil, err
+	}
+	locations[name] = loc
+	return loc, nil
+}
+
+// checkTimezone returns an error if a timezone is set but is not a known IANA
+// location name such as "Australia/Melbourne"
+func checkTimezone(name string) error {
+	if name == "" {
+		return nil
+	}
+	if _, err := loadLocation(name); err != nil {
+		return fmt.Errorf("unknown timezone '%s': %v", name, err)
+	}
+	return nil
+}
+
+// location returns the first of the named timezones which is set and known,
+// or UTC if there is none
+func location(names ...string) *time.Location {
+	for _, name := range names {
+		if name == "" {
+			continue
+		}
+		if loc, err := loadLocation(name); err == nil {
+			return loc
+		}
+	}
+	return time.UTC
+}
+
+// wallClock returns the time at which a clock in loc shows the same date and
+// time as a UTC clock does at t
+func wallClock(t int64, loc *time.Location) int64 {
+	u := time.Unix(t, 0).UTC()
+	return time.Date(u.Year(), u.Month(), u.Day(), u.Hour(), u.Minute(), u.Second(), 0, loc).Unix()
+}
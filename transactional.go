@@ -0,0 +1,166 @@
+package maillist
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// Transactional is a one-off e-mail to a single recipient, such as a password
+// reset or a ticket receipt. Its Subject, Preheader, Body, HTMLBody and
+// Address are as for a campaign, and are given inline or taken from the
+// campaign identified by TemplateID (e.g. a draft kept for the purpose) where
+// they are left empty.
+// The recipient is the account's subscriber with the given Email, who is
+// added if they don't already exist. Any Attributes are set on the subscriber
+// before the e-mail is rendered.
+type Transactional struct {
+	AccountID  int64
+	TemplateID int64
+	Subject    string
+	Preheader  string
+	Body       string
+	HTMLBody   string
+	Address    string
+
+	Email      string
+	FirstName  string
+	LastName   string
+	Attributes map[string]string
+}
+
+// SendTransactional queues a transactional e-mail, which is sent ahead of any
+// campaign messages and without waiting for the account's sending window or
+// warm-up. It is sent to subscribers who have unsubscribed, but not to those
+// who have reported spam. The returned ID may be passed to GetTransactional
+// to find out whether it has been delivered.
+func (s *Session) SendTransactional(t *Transactional) (int64, error) {
+	return s.SendTransactionalContext(context.Background(), t)
+}
+
+// SendTransactionalContext is like SendTransactional but with a context
+func (s *Session) SendTransactionalContext(ctx context.Context, t *Transactional) (int64, error) {
+	c := Campaign{
+		AccountID: t.AccountID,
+		Subject:   t.Subject,
+		Preheader: t.Preheader,
+		Body:      t.Body,
+		HTMLBody:  t.HTMLBody,
+		Address:   t.Address,
+		Status:    "transactional",
+		Scheduled: time.Now().Unix(),
+	}
+
+	if t.TemplateID != 0 {
+		tmpl, err := s.GetCampaignContext(ctx, t.TemplateID)
+		if err != nil {
+			return 0, fmt.Errorf("couldn't get template %d: %v", t.TemplateID, err)
+		}
+		if tmpl.AccountID != t.AccountID {
+			return 0, fmt.Errorf("template %d doesn't belong to account %d", t.TemplateID, t.AccountID)
+		}
+		if c.Subject == "" {
+			c.Subject = tmpl.Subject
+		}
+		if c.Preheader == "" {
+			c.Preheader = tmpl.Preheader
+		}
+		if c.Body == "" && c.HTMLBody == "" {
+			c.Body, c.HTMLBody = tmpl.Body, tmpl.HTMLBody
+		}
+		if c.Address == "" {
+			c.Address = tmpl.Address
+		}
+	}
+
+	if err := checkBody(&c); err != nil {
+		return 0, err
+	}
+	if err := s.checkTemplates(&c); err != nil {
+		return 0, err
+	}
+	if err := checkAttributes(t.Attributes); err != nil {
+		return 0, err
+	}
+
+	sub, err := s.GetSubscriberByEmailContext(ctx, t.Email, t.AccountID)
+	if err == ErrNotFound {
+		sub = &Subscriber{
+			AccountID: t.AccountID,
+			FirstName: t.FirstName,
+			LastName:  t.LastName,
+			Email:     t.Email,
+		}
+		if err = s.InsertSubscriberContext(ctx, sub); err != nil {
+			return 0, err
+		}
+
+	} else if err != nil {
+		return 0, err
+	}
+
+	if err = s.SetSubscriberAttributesContext(ctx, sub.ID, t.Attributes); err != nil {
+		return 0, err
+	}
+
+	c.CreateTime = time.Now().Unix()
+	if err = validate.Struct(&c); err != nil {
+		return 0, err
+	}
+
+	tx, err := s.dbmap.Begin()
+	if err != nil {
+		return 0, err
+	}
+	if err = tx.WithContext(ctx).Insert(&c); err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+
+	m := Message{
+		SubscriberID: sub.ID,
+		CampaignID:   c.ID,
+		Status:       "pending",
+		Domain:       emailDomain(sub.Email),
+		CreateTime:   time.Now().Unix(),
+	}
+	if err = tx.WithContext(ctx).Insert(&m); err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	if err = tx.Commit(); err != nil {
+		return 0, fmt.Errorf("couldn't commit transactional e-mail: %v", err)
+	}
+
+	s.wakeSender()
+	return c.ID, nil
+}
+
+// GetTransactional retrieves the message of a transactional e-mail, whose
+// Status is `sent` once it has been delivered to the mailer
+func (s *Session) GetTransactional(id int64) (*Message, error) {
+	return s.GetTransactionalContext(context.Background(), id)
+}
+
+// GetTransactionalContext is like GetTransactional but with a context
+func (s *Session) GetTransactionalContext(ctx context.Context, id int64) (*Message, error) {
+
+	selectSQL := fmt.Sprintf(`
+SELECT %s
+	FROM message
+
+WHERE campaign_id=?
+	AND EXISTS (SELECT 1 FROM campaign WHERE id=? AND status='transactional')`,
+		s.selectString(Message{}))
+
+	var m Message
+	if err := s.dbmap.WithContext(ctx).SelectOne(&m, selectSQL, id, id); err == sql.ErrNoRows {
+		return nil, ErrNotFound
+
+	} else if err != nil {
+		return nil, err
+	}
+
+	return &m, nil
+}
@@ -0,0 +1,297 @@
+package maillist
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// parseWarmup parses a warm-up ramp, a comma separated list of the most
+// messages an account may send on each day of its warm-up, e.g.
+// "50,100,500,1000". An account is unlimited once its ramp is over.
+func parseWarmup(spec string) ([]int, error) {
+	if strings.TrimSpace(spec) == "" {
+		return nil, nil
+	}
+
+	var ramp []int
+	for _, field := range strings.Split(spec, ",") {
+		n, err := strconv.Atoi(strings.TrimSpace(field))
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("warm-up '%s': '%s' is not a positive number of messages", spec, field)
+		}
+		ramp = append(ramp, n)
+	}
+	return ramp, nil
+}
+
+// checkWarmup returns an error if an account's warm-up ramp is invalid. The
+// warm-up of an account with a ramp starts now unless WarmupStart is set.
+func checkWarmup(a *Account) error {
+	ramp, err := parseWarmup(a.Warmup)
+	if err != nil {
+		return err
+	}
+	if len(ramp) > 0 && a.WarmupStart == 0 {
+		a.WarmupStart = time.Now().Unix()
+	}
+	return nil
+}
+
+// warmupLimit returns the most messages which may be sent on the day of t
+// under a ramp starting at start, counting days in loc, or -1 if there is no
+// limit
+func warmupLimit(ramp []int, start int64, t time.Time, loc *time.Location) int {
+	day := int(date(t, loc).Sub(date(time.Unix(start, 0), loc)) / (24 * time.Hour))
+	if day < 0 {
+		day = 0
+	}
+	if day >= len(ramp) {
+		return -1
+	}
+	return ramp[day]
+}
+
+// date returns midnight UTC of the date shown by a clock in loc at t, so that
+// the number of days between two dates isn't affected by daylight saving
+func date(t time.Time, loc *time.Location) time.Time {
+	t = t.In(loc)
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+}
+
+// tomorrow returns the start of the day after t in loc
+func tomorrow(t time.Time, loc *time.Location) time.Time {
+	t = t.In(loc)
+	return time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, loc)
+}
+
+// limitWarmup removes messages from a job which would take its account over
+// the day's limit of its warm-up ramp. These, and the account's other pending
+// messages, are carried over to the next day. The messages which remain are
+// counted against the limit, and the returned reservation should be passed to
+// refundWarmup once they have been sent.
+func (s *Session) limitWarmup(ctx context.Context, j *job, account *Account) (*warmupReservation, error) {
+	ramp, err := parseWarmup(account.Warmup)
+	if err != nil || len(ramp) == 0 {
+		return nil, err
+	}
+
+	now := time.Now()
+	loc := location(account.Timezone)
+	limit := warmupLimit(ramp, account.WarmupStart, now, loc)
+	if limit < 0 {
+		return nil, nil
+	}
+
+	r := warmupReservation{accountID: account.ID, day: date(now, loc)}
+	if r.n, err = s.reserveWarmup(ctx, r.accountID, r.day, limit, len(j.messages)); err != nil {
+		return nil, err
+	}
+	if r.n == len(j.messages) {
+		return &r, nil
+	}
+
+	var ids []interface{}
+	for _, m := range j.messages[r.n:] {
+		ids = append(ids, m.SubscriberID)
+		// the domain throttle has already counted the message
+		s.domains.refund(m.Domain)
+	}
+
+	updateSQL := fmt.Sprintf(`
+UPDATE message
+	SET status='pending', owner='', next_attempt=?
+
+WHERE campaign_id IN (SELECT id FROM campaign WHERE account_id=? AND status!='transactional')
+	AND ((status='pending' AND next_attempt<?)
+		OR (status='sending' AND owner=? AND campaign_id=? AND subscriber_id IN (%s)))`,
+		sqlPlaceholders(len(ids)))
+
+	next := tomorrow(now, loc).Unix()
+	args := append([]interface{}{next, account.ID, next, j.owner, j.campaignID}, ids...)
+	if _, err = s.dbmap.WithContext(ctx).Exec(updateSQL, args...); err != nil {
+		s.refundWarmup(j, &r)
+		return nil, err
+	}
+
+	j.messages = j.messages[:r.n]
+	return &r, nil
+}
+
+// warmupReservation is the part of an account's warm-up limit for a day which
+// has been reserved by a job
+type warmupReservation struct {
+	accountID int64
+	day       time.Time
+	n         int
+}
+
+// refundWarmup returns the part of a job's reservation which wasn't used, by
+// messages which failed, will be retried or were cancelled, to the account's
+// limit for the day. It isn't given a context, as it is called after sending
+// whether or not it completed.
+func (s *Session) refundWarmup(j *job, r *warmupReservation) {
+	if r == nil || r.n == 0 {
+		return
+	}
+	db := s.dbmap.WithContext(context.Background())
+
+	sent, err := db.SelectInt("SELECT count(*) FROM message WHERE owner=? AND status='sent'", j.owner)
+	if err != nil {
+		s.error("couldn't count sent messages for warm-up:", err)
+		return
+	}
+	if unused := int64(r.n) - sent; unused > 0 {
+		updateSQL := `
+UPDATE warmup
+	SET sent=GREATEST(sent-?, 0)
+
+WHERE account_id=?
+	AND day=?`
+
+		if _, err = db.Exec(updateSQL, unused, r.accountID, r.day.Format("2006-01-02")); err != nil {
+			s.error("couldn't refund warm-up limit:", err)
+		}
+	}
+}
+
+// reserveWarmup counts up to n messages against an account's limit for a day,
+// and returns how many may be sent
+func (s *Session) reserveWarmup(ctx context.Context, accountID int64, day time.Time, limit, n int) (int, error) {
+	tx, err := s.dbmap.Begin()
+	if err != nil {
+		return 0, err
+	}
+	db := tx.WithContext(ctx)
+
+	insertSQL := `
+INSERT IGNORE INTO warmup
+	(account_id, day, sent)
+
+VALUES
+	(?, ?, 0)`
+
+	if _, err = db.Exec(insertSQL, accountID, day.Format("2006-01-02")); err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+
+	sent, err := db.SelectInt("SELECT sent FROM warmup WHERE account_id=? AND day=? FOR UPDATE",
+		accountID, day.Format("2006-01-02"))
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+
+	granted := limit - int(sent)
+	if granted > n {
+		granted = n
+	} else if granted < 0 {
+		granted = 0
+	}
+
+	updateSQL := `
+UPDATE warmup
+	SET sent=sent+?
+
+WHERE account_id=?
+	AND day=?`
+
+	if _, err = db.Exec(updateSQL, granted, accountID, day.Format("2006-01-02")); err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	if err = tx.Commit(); err != nil {
+		return 0, fmt.Errorf("couldn't commit warm-up count: %v", err)
+	}
+	return granted, nil
+}
+
+// WarmupDaysRemaining returns the number of days, including the current one,
+// which a campaign will take to send under its account's warm-up ramp,
+// assuming the account sends nothing else in the meantime. It is 0 if the
+// campaign has nothing left to send, and 1 if it is sent in full on the day
+// it is due. Campaigns yet to be sent are counted from the day they are
+// scheduled, to the active subscribers of their lists.
+func (s *Session) WarmupDaysRemaining(campaignID int64) (int, error) {
+	return s.WarmupDaysRemainingContext(context.Background(), campaignID)
+}
+
+// WarmupDaysRemainingContext is like WarmupDaysRemaining but with a context
+func (s *Session) WarmupDaysRemainingContext(ctx context.Context, campaignID int64) (int, error) {
+	c, err := s.GetCampaignContext(ctx, campaignID)
+	if err != nil {
+		return 0, err
+	}
+	account, err := s.GetAccountContext(ctx, c.AccountID)
+	if err != nil {
+		return 0, fmt.Errorf("couldn't get account: %v", err)
+	}
+	ramp, err := parseWarmup(account.Warmup)
+	if err != nil {
+		return 0, err
+	}
+
+	db := s.dbmap.WithContext(ctx)
+	day := time.Now()
+	var remaining int64
+
+	switch c.Status {
+	case "pending", "paused":
+		remaining, err = db.SelectInt(`
+SELECT count(*)
+	FROM message
+
+WHERE status IN ('pending','sending')
+	AND campaign_id=?`, campaignID)
+
+	case "scheduled", "draft", "recurring":
+		listIDs := stringToInts(c.ListIDs)
+		if len(listIDs) == 0 {
+			break
+		}
+		args := make([]interface{}, len(listIDs))
+		for i, id := range listIDs {
+			args[i] = id
+		}
+		remaining, err = db.SelectInt(fmt.Sprintf(`
+SELECT count(DISTINCT subscriber.email)
+	FROM subscriber
+
+INNER JOIN list_subscriber
+	ON subscriber.id=subscriber_id
+
+WHERE subscriber.status='active'
+	AND list_id IN (%s)`, sqlPlaceholders(len(args))), args...)
+
+		if scheduled := time.Unix(c.Scheduled, 0); scheduled.After(day) {
+			day = scheduled
+		}
+	}
+	if err != nil || remaining == 0 {
+		return 0, err
+	}
+
+	loc := location(account.Timezone)
+	for days := 1; ; days++ {
+		limit := warmupLimit(ramp, account.WarmupStart, day, loc)
+		if limit < 0 {
+			return days, nil
+		}
+
+		sent, err := db.SelectInt("SELECT sent FROM warmup WHERE account_id=? AND day=?",
+			account.ID, date(day, loc).Format("2006-01-02"))
+		if err != nil {
+			return 0, err
+		}
+		if limit > int(sent) {
+			remaining -= int64(limit) - sent
+		}
+		if remaining <= 0 {
+			return days, nil
+		}
+		day = tomorrow(day, loc)
+	}
+}
@@ -0,0 +1,153 @@
+package maillist
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// sendingWindow is the set of times at which an account's messages may be
+// sent, as the intervals allowed on each day of the week in minutes since
+// midnight
+type sendingWindow [7][][2]int
+
+// parseSendingWindow parses a list of days and times separated by semicolons,
+// such as "mon-fri 08:00-20:00; sat 10:00-12:00". Days may be a range, a
+// comma separated list or "*" for every day, and each clause may list several
+// time ranges separated by commas. A time range ends at 24:00 at the latest.
+func parseSendingWindow(spec string) (*sendingWindow, error) {
+	var w sendingWindow
+
+	for _, clause := range strings.Split(spec, ";") {
+		fields := strings.Fields(clause)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("sending window '%s' should be days followed by times", clause)
+		}
+
+		days, err := parseCronField(fields[0], 0, 7, dayNames)
+		if err != nil {
+			return nil, fmt.Errorf("sending window '%s': %v", clause, err)
+		}
+		if days&(1<<7) != 0 {
+			days |= 1
+		}
+
+		for _, rng := range strings.Split(fields[1], ",") {
+			i := strings.Index(rng, "-")
+			if i < 0 {
+				return nil, fmt.Errorf("sending window '%s': '%s' is not a time range", clause, rng)
+			}
+			start, err := parseClock(rng[:i])
+			if err != nil {
+				return nil, fmt.Errorf("sending window '%s': %v", clause, err)
+			}
+			end, err := parseClock(rng[i+1:])
+			if err != nil {
+				return nil, fmt.Errorf("sending window '%s': %v", clause, err)
+			}
+			if end <= start {
+				return nil, fmt.Errorf("sending window '%s': '%s' ends before it starts", clause, rng)
+			}
+
+			for day := 0; day < 7; day++ {
+				if days&(1<<uint(day)) != 0 {
+					w[day] = append(w[day], [2]int{start, end})
+				}
+			}
+		}
+	}
+
+	for _, day := range w {
+		sort.Slice(day, func(i, j int) bool { return day[i][0] < day[j][0] })
+	}
+	return &w, nil
+}
+
+// parseClock parses a time of day in the form 15:04 into minutes since
+// midnight. 24:00 is accepted as the end of the day.
+func parseClock(s string) (int, error) {
+	i := strings.Index(s, ":")
+	if i < 0 {
+		return 0, fmt.Errorf("'%s' is not a time of day", s)
+	}
+	h, err1 := strconv.Atoi(s[:i])
+	m, err2 := strconv.Atoi(s[i+1:])
+	if err1 != nil || err2 != nil || h < 0 || m < 0 || m > 59 || h*60+m > 24*60 {
+		return 0, fmt.Errorf("'%s' is not a time of day", s)
+	}
+	return h*60 + m, nil
+}
+
+// opens returns the earliest time no earlier than t, in loc, at which the
+// window is open, or the zero time if it never is
+func (w *sendingWindow) opens(t time.Time, loc *time.Location) time.Time {
+	t = t.In(loc)
+	for i := 0; i <= 7; i++ {
+		day := time.Date(t.Year(), t.Month(), t.Day()+i, 0, 0, 0, 0, loc)
+		for _, rng := range w[day.Weekday()] {
+			start := time.Date(day.Year(), day.Month(), day.Day(), 0, rng[0], 0, 0, loc)
+			end := time.Date(day.Year(), day.Month(), day.Day(), 0, rng[1], 0, 0, loc)
+			if t.Before(end) {
+				if t.After(start) {
+					return t
+				}
+				return start
+			}
+		}
+	}
+	return time.Time{}
+}
+
+// checkSendingWindow returns an error if an account's sending window is set
+// but invalid
+func checkSendingWindow(spec string) error {
+	if spec == "" {
+		return nil
+	}
+	w, err := parseSendingWindow(spec)
+	if err != nil {
+		return err
+	}
+	if w.opens(time.Now(), time.UTC).IsZero() {
+		return fmt.Errorf("sending window '%s' is never open", spec)
+	}
+	return nil
+}
+
+// deferOutsideWindow checks whether a job's account may send now. If not, the
+// job's messages, and any other pending messages of its campaign, are
+// returned to the queue until the account's sending window next opens. It
+// returns whether the job was deferred.
+func (s *Session) deferOutsideWindow(ctx context.Context, j *job, account *Account) (bool, error) {
+	if account.SendingWindow == "" {
+		return false, nil
+	}
+
+	w, err := parseSendingWindow(account.SendingWindow)
+	if err != nil {
+		return false, err
+	}
+
+	now := time.Now()
+	opens := w.opens(now, location(account.Timezone))
+	if !opens.After(now) {
+		return false, nil
+	}
+
+	updateSQL := `
+UPDATE message
+	SET status='pending', owner='', next_attempt=?
+
+WHERE campaign_id=?
+	AND ((status='pending' AND next_attempt<?)
+		OR (status='sending' AND owner=?))`
+
+	_, err = s.dbmap.WithContext(ctx).Exec(updateSQL, opens.Unix(), j.campaignID, opens.Unix(), j.owner)
+	return true, err
+}
@@ -0,0 +1,137 @@
+package maillist
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// job is a group of messages from a single campaign, claimed by one worker
+type job struct {
+	campaignID int64
+	owner      string
+	messages   []*Message
+}
+
+// drain sends all pending messages using a pool of workers, each claiming
+// messages from the queue until it is empty. A worker stops early if it
+// encounters an error, leaving its remaining messages for a later attempt.
+// Claims are renewed for as long as their messages are being sent.
+// Workers stop claiming once the session begins shutting down, and abandon
+// the messages they hold once the context is done.
+func (s *Session) drain(ctx context.Context) {
+	workers := s.config.Workers
+	if workers < 1 {
+		workers = 1
+	}
+	size := 1
+	if _, batch := s.mailer.(BatchMailer); batch {
+		size = maxBatch
+	}
+	// don't claim more messages than can be sent within half a lease
+	if rate := s.config.MaxPerSecond; rate > 0 {
+		if max := int(rate * s.config.ClaimLease.Seconds() / 2); max < size {
+			size = max
+		}
+		if size < 1 {
+			size = 1
+		}
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for !s.stopping() {
+				j, err := s.claim(ctx, size)
+				if err == ErrNotFound {
+					return
+
+				} else if err != nil {
+					if ctx.Err() == nil {
+						s.error("couldn't claim pending messages:", err)
+					}
+					return
+				}
+
+				stop := s.renewClaim(ctx, j)
+				err = s.process(ctx, j)
+				stop()
+				// release even if ctx is done, so the messages needn't wait
+				// for their lease to expire
+				if err2 := s.release(context.Background(), j); err2 != nil {
+					s.error("couldn't release claimed messages:", err2)
+				}
+				if err != nil {
+					if ctx.Err() == nil {
+						s.error(err)
+					}
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// process sends the messages of a job, in a single batch if the mailer
+// supports it. Jobs outside their account's sending window are deferred, as
+// are messages to domains which have reached their limit and those over the
+// account's daily warm-up limit. Transactional e-mails are only subject to
+// the domain limits.
+func (s *Session) process(ctx context.Context, j *job) error {
+	campaign, err := s.GetCampaignContext(ctx, j.campaignID)
+	if err != nil {
+		return s.lookupFailed(ctx, fmt.Errorf("couldn't get campaign %d: %v", j.campaignID, err), err, j.messages...)
+	}
+	account, err := s.GetAccountContext(ctx, campaign.AccountID)
+	if err != nil {
+		return s.lookupFailed(ctx, fmt.Errorf("couldn't get account %d: %v", campaign.AccountID, err), err, j.messages...)
+	}
+
+	transactional := campaign.Status == "transactional"
+
+	if !transactional {
+		if deferred, err := s.deferOutsideWindow(ctx, j, account); err != nil || deferred {
+			return err
+		}
+	}
+
+	if err := s.throttle(ctx, j); err != nil || len(j.messages) == 0 {
+		return err
+	}
+
+	if !transactional {
+		r, err := s.limitWarmup(ctx, j, account)
+		defer s.refundWarmup(j, r)
+		if err != nil || len(j.messages) == 0 {
+			return err
+		}
+	}
+
+	if err := s.limiter.wait(ctx, len(j.messages)); err != nil {
+		return err
+	}
+	if mailer, ok := s.mailer.(BatchMailer); ok {
+		return s.sendBatch(ctx, mailer, j.campaignID, j.messages)
+	}
+
+	for _, m := range j.messages {
+		if err := s.sendMessage(ctx, m); err != nil {
+			return fmt.Errorf("couldn't send message to subscriber %d: %v", m.SubscriberID, err)
+		}
+	}
+	return nil
+}
+
+// lookupFailed handles a failure to retrieve the campaign or account of some
+// messages. If it no longer exists (e.g. because the account was deleted while
+// the campaign was being sent) the messages fail permanently, rather than
+// being claimed again forever. Other errors are returned.
+func (s *Session) lookupFailed(ctx context.Context, err, lookupErr error, ms ...*Message) error {
+	if lookupErr != ErrNotFound {
+		return err
+	}
+	return s.messageFailed(ctx, &PermanentError{err}, ms...)
+}